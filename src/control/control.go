@@ -0,0 +1,291 @@
+// Package control is the local endpoint of a running backup daemon. A client sends a request as a line of json
+// and gets a response the same way, one request per connection. The unix socket is protected by its file mode,
+// the optional tcp listener only accepts localhost and requires a token.
+package control
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"glog"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// the commands of requests
+const (
+	// run a task right now
+	CommandTrigger = "trigger"
+	// defer the runs of a task until it is resumed
+	CommandPause  = "pause"
+	CommandResume = "resume"
+	// reload the config file
+	CommandReload = "reload"
+	// get the status of the tasks
+	CommandStatus = "status"
+	// list the snapshots of a task
+	CommandSnapshots = "snapshots"
+	// list the files under a directory of a snapshot
+	CommandFiles = "files"
+	// restore files of a snapshot
+	CommandRestore = "restore"
+	// shut down the daemon once the runs in progress finished, like a signal
+	CommandStop = "stop"
+)
+
+// the states of tasks
+const (
+	StateIdle    = "idle"
+	StateRunning = "running"
+	StatePaused  = "paused"
+)
+
+// the max duration of a connection
+const Timeout = time.Second * 10
+
+var (
+	ErrUnauthorized = errors.New("invalid token")
+	ErrNotLocal     = errors.New("control address should be on localhost")
+)
+
+type Request struct {
+	Command string `json:"command"`
+	Task    string `json:"task,omitempty"`
+	// the snapshot of files and restore, the latest backup if empty
+	Snapshot string `json:"snapshot,omitempty"`
+	// the directory of files, relative to the backup root and separated by /
+	Dir string `json:"dir,omitempty"`
+	// the options of restore, see restore.Options. The target is the original src if empty.
+	Target   string   `json:"target,omitempty"`
+	Globs    []string `json:"globs,omitempty"`
+	Paths    []string `json:"paths,omitempty"`
+	Conflict string   `json:"conflict,omitempty"`
+	// required by the tcp listener
+	Token string `json:"token,omitempty"`
+}
+
+type TaskStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// zero if the task never succeeded
+	LastSuccTime time.Time `json:"last_succ_time,omitzero"`
+	// zero if the task runs after other tasks or on changes
+	NextRun      time.Time `json:"next_run,omitzero"`
+	RecentResult []string  `json:"recent_result"`
+	// the result and the copy engine output of the last failed run
+	LastError         string    `json:"last_error,omitempty"`
+	LastCheckTime     time.Time `json:"last_check_time,omitzero"`
+	RecentCheckResult []string  `json:"recent_check_result,omitempty"`
+	// set while the task is running
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// Progress is the progress of a run in progress
+type Progress struct {
+	Started time.Time `json:"started"`
+	// the files done so far and their bytes, copied or not
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// the last file done
+	File string `json:"file"`
+}
+
+type Snapshot struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// FileEntry is a file or directory directly under the directory of files
+type FileEntry struct {
+	Name string `json:"name"`
+	Dir  bool   `json:"dir"`
+	// the total size of the files under a directory
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type Response struct {
+	// empty if the request succeeded
+	Error     string       `json:"error,omitempty"`
+	Tasks     []TaskStatus `json:"tasks,omitempty"`
+	Snapshots []Snapshot   `json:"snapshots,omitempty"`
+	Files     []FileEntry  `json:"files,omitempty"`
+	// the summary of restore
+	Message string `json:"message,omitempty"`
+}
+
+// Handler handles a request, the error is sent to the client
+type Handler func(req Request) (*Response, error)
+
+type Server struct {
+	handler   Handler
+	token     string
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+// Listen serves handler on the unix socket, and on the tcp address if it is not empty.
+// A socket left by a daemon no longer running is replaced.
+func Listen(socket, address, token string, handler Handler) (*Server, error) {
+	s := &Server{handler: handler, token: token}
+	if err := removeStaleSocket(socket); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	// on windows the socket is protected by the acl of its directory
+	if runtime.GOOS != "windows" {
+		if err = os.Chmod(socket, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	s.listeners = append(s.listeners, l)
+	if address != "" {
+		if err = CheckAddress(address); err != nil {
+			l.Close()
+			return nil, err
+		}
+		tl, err := net.Listen("tcp", address)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, tl)
+	}
+	for _, l := range s.listeners {
+		s.wg.Add(1)
+		go s.serve(l)
+	}
+	return s, nil
+}
+
+// CheckAddress return ErrNotLocal if address is not a loopback host and port
+func CheckAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !isLocalHost(host) {
+		return ErrNotLocal
+	}
+	return nil
+}
+
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func removeStaleSocket(socket string) error {
+	if _, err := os.Lstat(socket); err != nil {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return errors.New("another daemon is listening on " + socket)
+	}
+	return os.Remove(socket)
+}
+
+// Close stops listening, and waits for the connections in progress
+func (s *Server) Close() error {
+	var err error
+	for _, l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve(l net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+	var req Request
+	var resp *Response
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	if err == nil && conn.LocalAddr().Network() == "tcp" &&
+		subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.token)) != 1 {
+		err = ErrUnauthorized
+	}
+	if err == nil {
+		resp, err = s.handler(req)
+	}
+	if resp == nil {
+		resp = &Response{}
+	}
+	if err != nil {
+		glog.Warningf("control request %v of task %v from %v failed: %v", req.Command, req.Task, conn.RemoteAddr(), err)
+		resp.Error = err.Error()
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	if _, err = conn.Write(append(data, '\n')); err != nil {
+		glog.Warningf("control response to %v failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// Call sends req to the daemon listening on the address of the network, "unix" or "tcp",
+// an error of the request is returned as error.
+func Call(network, address string, req Request) (*Response, error) {
+	conn, err := net.DialTimeout(network, address, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err = json.Unmarshal(line, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
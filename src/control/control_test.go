@@ -0,0 +1,99 @@
+package control
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testHandler(req Request) (*Response, error) {
+	switch req.Command {
+	case CommandStatus:
+		return &Response{Tasks: []TaskStatus{{Name: "docs", State: StateIdle}}}, nil
+	case CommandTrigger:
+		if req.Task != "docs" {
+			return nil, errors.New("task " + req.Task + " not found")
+		}
+		return nil, nil
+	case CommandFiles:
+		return &Response{Files: []FileEntry{{Name: req.Snapshot + "/" + req.Dir}}}, nil
+	case CommandRestore:
+		return &Response{Message: "restored " + strings.Join(req.Globs, ",") + " to " + req.Target}, nil
+	}
+	return nil, errors.New("unknown command " + req.Command)
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "backup.sock")
+
+	s, err := Listen(socket, "127.0.0.1:0", "secret", testHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := Call("unix", socket, Request{Command: CommandStatus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Tasks) != 1 || resp.Tasks[0].Name != "docs" || resp.Tasks[0].State != StateIdle {
+		t.Errorf("status = %+v", resp)
+	}
+	if _, err = Call("unix", socket, Request{Command: CommandTrigger, Task: "docs"}); err != nil {
+		t.Error(err)
+	}
+	if _, err = Call("unix", socket, Request{Command: CommandTrigger, Task: "music"}); err == nil || err.Error() != "task music not found" {
+		t.Errorf("trigger of unknown task err = %v", err)
+	}
+
+	// tcp requires the token
+	address := s.listeners[1].Addr().String()
+	if _, err = Call("tcp", address, Request{Command: CommandStatus}); err == nil || err.Error() != ErrUnauthorized.Error() {
+		t.Errorf("tcp without token err = %v", err)
+	}
+	if _, err = Call("tcp", address, Request{Command: CommandStatus, Token: "secret"}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = Listen(socket, "", "", testHandler); err == nil {
+		t.Error("listen on the socket of a running daemon should fail")
+	}
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// a socket file left behind is replaced
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	s, err = Listen(socket, "", "", testHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestCheckAddress(t *testing.T) {
+	for address, want := range map[string]bool{
+		"127.0.0.1:7300": true,
+		"localhost:7300": true,
+		"[::1]:7300":     true,
+		"0.0.0.0:7300":   false,
+		"10.0.0.2:7300":  false,
+		":7300":          false,
+	} {
+		if err := CheckAddress(address); (err == nil) != want {
+			t.Errorf("CheckAddress(%v) = %v", address, err)
+		}
+	}
+}
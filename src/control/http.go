@@ -0,0 +1,178 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"glog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// APIHandler return the REST api of handler:
+//
+//	GET  /api/tasks                 the status of the tasks
+//	GET  /api/tasks/<name>          the status of a task
+//	POST /api/tasks/<name>/trigger  run a task right now, pause and resume likewise
+//	GET  /api/tasks/<name>/snapshots
+//	GET  /api/tasks/<name>/files?snapshot=<snapshot>&dir=<dir>
+//	POST /api/tasks/<name>/restore  restore files, the body is Request in json, only if token is not empty
+//
+// Responses are Response in json, with an error status code if the error is set.
+// If token is not empty, requests must send the header "Authorization: Bearer <token>".
+// Requests from other web sites are refused: POST requests must have the content type application/json, which
+// browsers do not send across sites without asking, a request with an Origin header must come from the same host,
+// and without a token the Host header must be localhost, against DNS rebinding.
+func APIHandler(handler Handler, token string) http.Handler {
+	return &api{handler: handler, token: token}
+}
+
+type api struct {
+	handler Handler
+	token   string
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		writeResponse(w, http.StatusUnauthorized, &Response{Error: ErrUnauthorized.Error()})
+		return
+	}
+	if err := a.checkSite(r); err != nil {
+		writeResponse(w, http.StatusForbidden, &Response{Error: err.Error()})
+		return
+	}
+	if r.URL.Path != "/api/tasks" && !strings.HasPrefix(r.URL.Path, "/api/tasks/") {
+		writeResponse(w, http.StatusNotFound, &Response{Error: "not found"})
+		return
+	}
+	var name, command string
+	if parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tasks"), "/"), "/"); len(parts) > 2 {
+		writeResponse(w, http.StatusNotFound, &Response{Error: "not found"})
+		return
+	} else if len(parts) == 2 {
+		name, command = parts[0], parts[1]
+	} else {
+		name = parts[0]
+	}
+
+	method := http.MethodGet
+	switch command {
+	case "", CommandSnapshots, CommandFiles:
+	case CommandTrigger, CommandPause, CommandResume, CommandRestore:
+		method = http.MethodPost
+	default:
+		writeResponse(w, http.StatusNotFound, &Response{Error: "unknown command " + command})
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeResponse(w, http.StatusMethodNotAllowed, &Response{Error: "method " + r.Method + " not allowed"})
+		return
+	}
+	if method == http.MethodPost {
+		if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+			writeResponse(w, http.StatusUnsupportedMediaType, &Response{Error: "content type should be application/json"})
+			return
+		}
+	}
+	var req Request
+	switch command {
+	case CommandFiles:
+		req.Snapshot, req.Dir = r.URL.Query().Get("snapshot"), r.URL.Query().Get("dir")
+	case CommandRestore:
+		// restore writes files, so it is not open to any local user or process like the status
+		if a.token == "" {
+			writeResponse(w, http.StatusForbidden, &Response{Error: "restore requires the token of the control config"})
+			return
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeResponse(w, http.StatusBadRequest, &Response{Error: err.Error()})
+			return
+		}
+		// a restore may take longer than the write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	}
+
+	resp, err := a.handler(Request{Command: CommandStatus})
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, &Response{Error: err.Error()})
+		return
+	}
+	if name == "" {
+		writeResponse(w, http.StatusOK, resp)
+		return
+	}
+	var task *TaskStatus
+	for i := range resp.Tasks {
+		if strings.EqualFold(resp.Tasks[i].Name, name) {
+			task = &resp.Tasks[i]
+			break
+		}
+	}
+	if task == nil {
+		writeResponse(w, http.StatusNotFound, &Response{Error: "task " + name + " not found"})
+		return
+	}
+	if command == "" {
+		writeResponse(w, http.StatusOK, &Response{Tasks: []TaskStatus{*task}})
+		return
+	}
+	req.Command, req.Task = command, task.Name
+	if resp, err = a.handler(req); err != nil {
+		if resp == nil {
+			resp = &Response{}
+		}
+		resp.Error = err.Error()
+		writeResponse(w, http.StatusConflict, resp)
+		return
+	}
+	if resp == nil {
+		resp = &Response{}
+	}
+	writeResponse(w, http.StatusOK, resp)
+}
+
+// checkSite return an error if r may be sent by a page of another site
+func (a *api) checkSite(r *http.Request) error {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if a.token == "" && !isLocalHost(strings.Trim(host, "[]")) {
+		return errors.New("host " + r.Host + " not allowed, configure the token to use other hosts")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return errors.New("origin " + origin + " not allowed")
+		}
+	}
+	return nil
+}
+
+func writeResponse(w http.ResponseWriter, code int, resp *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		glog.Warningf("write http response failed: %v", err)
+	}
+}
+
+// ListenHTTP serves handler on the tcp address
+func ListenHTTP(address string, handler http.Handler) (*http.Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler, ReadTimeout: Timeout, WriteTimeout: Timeout}
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			glog.Errorf("http server on %v stopped: %v", address, err)
+		}
+	}()
+	return server, nil
+}
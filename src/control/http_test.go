@@ -0,0 +1,169 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	server := httptest.NewServer(APIHandler(testHandler, "secret"))
+	defer server.Close()
+
+	for _, c := range []struct {
+		method, path string
+		token        string
+		code         int
+		tasks        int
+	}{
+		{http.MethodGet, "/api/tasks", "secret", http.StatusOK, 1},
+		{http.MethodGet, "/api/tasks", "", http.StatusUnauthorized, 0},
+		{http.MethodGet, "/api/tasks/Docs", "secret", http.StatusOK, 1},
+		{http.MethodGet, "/api/tasks/music", "secret", http.StatusNotFound, 0},
+		{http.MethodPost, "/api/tasks/docs/trigger", "secret", http.StatusOK, 0},
+		{http.MethodGet, "/api/tasks/docs/trigger", "secret", http.StatusMethodNotAllowed, 0},
+		{http.MethodPost, "/api/tasks/docs/pause", "secret", http.StatusConflict, 0},
+		{http.MethodPost, "/api/tasks/docs/stop", "secret", http.StatusNotFound, 0},
+		{http.MethodGet, "/api/other", "secret", http.StatusNotFound, 0},
+	} {
+		req, err := http.NewRequest(c.method, server.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.method == http.MethodPost {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.path, err)
+		}
+		if res.StatusCode != c.code || len(resp.Tasks) != c.tasks || (c.code == http.StatusOK) != (resp.Error == "") {
+			t.Errorf("%s %s = %d %+v", c.method, c.path, res.StatusCode, resp)
+		}
+	}
+}
+
+func TestAPICrossSite(t *testing.T) {
+	server := httptest.NewServer(APIHandler(testHandler, ""))
+	defer server.Close()
+
+	for _, c := range []struct {
+		host, origin, contentType string
+		code                      int
+	}{
+		{"", "", "application/json", http.StatusOK},
+		{"", server.URL, "application/json; charset=utf-8", http.StatusOK},
+		{"localhost:7301", "http://localhost:7301", "application/json", http.StatusOK},
+		{"", "", "text/plain", http.StatusUnsupportedMediaType},
+		{"", "", "", http.StatusUnsupportedMediaType},
+		{"", "http://evil.example", "application/json", http.StatusForbidden},
+		{"", "null", "application/json", http.StatusForbidden},
+		{"evil.example:7301", "", "application/json", http.StatusForbidden},
+	} {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/tasks/docs/trigger", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.host != "" {
+			req.Host = c.host
+		}
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.code {
+			t.Errorf("host %q origin %q content type %q = %d, want %d", c.host, c.origin, c.contentType, res.StatusCode, c.code)
+		}
+	}
+
+	// with a token other hosts are allowed, as a page of another site can not send the token
+	server = httptest.NewServer(APIHandler(testHandler, "secret"))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/tasks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "backup.example:7301"
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("other host with token = %d", res.StatusCode)
+	}
+}
+
+func TestAPIFiles(t *testing.T) {
+	server := httptest.NewServer(APIHandler(testHandler, ""))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/tasks/docs/files?snapshot=s1&dir=a%2Fb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp Response
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	res.Body.Close()
+	if err != nil || len(resp.Files) != 1 || resp.Files[0].Name != "s1/a/b" {
+		t.Errorf("files = %+v, %v", resp, err)
+	}
+
+	body := `{"globs": ["a/b"], "target": "/tmp/x"}`
+	res, err = http.Post(server.URL+"/api/tasks/docs/restore", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("restore without a token configured = %d", res.StatusCode)
+	}
+
+	server = httptest.NewServer(APIHandler(testHandler, "secret"))
+	defer server.Close()
+	post := func(body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/tasks/docs/restore", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res = post(body)
+	resp = Response{}
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK || resp.Message != "restored a/b to /tmp/x" {
+		t.Errorf("restore = %d %+v, %v", res.StatusCode, resp, err)
+	}
+
+	res = post("{")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("restore with a bad body = %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,146 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	EngineNative   = "native"
+	EngineRobocopy = "robocopy"
+)
+
+const (
+	StatusCopied  = "copied"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+	StatusDeleted = "deleted"
+	StatusLinked  = "linked"
+)
+
+// Copier copies src into the dst directory.
+// If src is a regular file it is copied to dst/<file name>,
+// if src is a directory its content is copied into dst.
+// The copy stops with the error of ctx once ctx is done.
+type Copier interface {
+	Copy(ctx context.Context, src, dst string, opts Options) (*Report, error)
+}
+
+type Options struct {
+	// file name patterns that should not be copied, * can be used as wildcard
+	FilteredFiles []string
+	// remove the files of dst that no longer exist in src, only used when src is a directory
+	Mirror bool
+	// the max ratio of dst files a mirror is allowed to remove, the copy is aborted if exceeded
+	MaxDeleteRatio float64
+	// if set, files unchanged since the copy in LinkDest are hard linked to it instead of copied
+	LinkDest string
+	// re-read the copied files from dst and compare their SHA-256 with src
+	Verify bool
+	// if set, called before each file is copied, it may block to pause the copy or return an error to abort it
+	Wait func() error
+	// if set, called after each file is copied, skipped or failed, with its path relative to src and its size
+	Progress func(path string, size int64)
+}
+
+// wait is called before each file, it return the error of ctx once ctx is done
+func (o *Options) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if o.Wait == nil {
+		return nil
+	}
+	return o.Wait()
+}
+
+// done reports the result of a file to Progress
+func (o *Options) done(fr FileResult) {
+	if o.Progress != nil {
+		o.Progress(fr.Path, fr.Size)
+	}
+}
+
+// FileResult is the copy result of a single file
+type FileResult struct {
+	Path   string
+	Status string
+	Size   int64
+	Err    error
+}
+
+// Report is the result of a whole copy
+type Report struct {
+	Files   []FileResult
+	Copied  int
+	Skipped int
+	Failed  int
+	Deleted int
+	Linked  int
+	Bytes   int64
+	// files verified and the ones mismatched, when Options.Verify is set
+	Verified   int
+	Mismatched []string
+	// raw output of external copy engines
+	Output string
+}
+
+func (r *Report) add(fr FileResult) {
+	r.Files = append(r.Files, fr)
+	switch fr.Status {
+	case StatusCopied:
+		r.Copied++
+		r.Bytes += fr.Size
+	case StatusSkipped:
+		r.Skipped++
+	case StatusFailed:
+		r.Failed++
+	case StatusDeleted:
+		r.Deleted++
+	case StatusLinked:
+		r.Linked++
+	}
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("copied %d, linked %d, skipped %d, deleted %d, failed %d, %d bytes",
+		r.Copied, r.Linked, r.Skipped, r.Deleted, r.Failed, r.Bytes)
+	if r.Verified > 0 {
+		s += fmt.Sprintf(", verified %d, mismatched %d", r.Verified, len(r.Mismatched))
+	}
+	return s
+}
+
+// New return the copier of the engine, empty engine means native.
+func New(engine string) (Copier, error) {
+	switch strings.ToLower(engine) {
+	case "", EngineNative:
+		return &Native{}, nil
+	case EngineRobocopy:
+		if runtime.GOOS != "windows" {
+			return nil, errors.New("copy engine robocopy is only available on windows")
+		}
+		return &Robocopy{}, nil
+	default:
+		return nil, errors.New("unknown copy engine " + engine)
+	}
+}
+
+// IsFiltered report whether the file name matches one of the filtered patterns.
+// The match is case insensitive like robocopy /xf.
+func IsFiltered(name string, filtered []string) bool {
+	name = strings.ToLower(filepath.Base(name))
+	for _, pattern := range filtered {
+		if pattern == "" {
+			continue
+		}
+		if matched, err := filepath.Match(strings.ToLower(pattern), name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
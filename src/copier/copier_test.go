@@ -0,0 +1,227 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsFiltered(t *testing.T) {
+	filtered := []string{"*.ini", "hello.txt"}
+	names := map[string]bool{"desktop.ini": true, "Desktop.INI": true, "hello.txt": true,
+		filepath.Join("a", "hello.txt"): true, "hello.txt.bak": false, "world.txt": false}
+	for name, expected := range names {
+		if IsFiltered(name, filtered) != expected {
+			t.Errorf("IsFiltered(%s) should be %v", name, expected)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if c, err := New(""); err != nil || c == nil {
+		t.Errorf("default engine: %v %v", c, err)
+	}
+	if _, err := New(EngineRobocopy); (err == nil) != (runtime.GOOS == "windows") {
+		t.Errorf("robocopy engine on %v: %v", runtime.GOOS, err)
+	}
+	if _, err := New("rsync"); err == nil {
+		t.Error("unknown engine should fail")
+	}
+}
+
+func TestNativeCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), "a")
+	writeFile(t, filepath.Join(src, "sub", "b.txt"), "bb")
+	writeFile(t, filepath.Join(src, "sub", "desktop.ini"), "ini")
+
+	n := &Native{}
+	opts := Options{FilteredFiles: []string{"*.ini"}}
+	report, err := n.Copy(context.Background(), src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 2 || report.Bytes != 3 {
+		t.Errorf("unexpected report: %v", report)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dst, "sub", "b.txt")); err != nil || string(b) != "bb" {
+		t.Errorf("sub/b.txt not copied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "sub", "desktop.ini")); !os.IsNotExist(err) {
+		t.Error("filtered file should not be copied")
+	}
+
+	report, err = n.Copy(context.Background(), src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 0 || report.Skipped != 2 {
+		t.Errorf("unchanged files should be skipped: %v", report)
+	}
+
+	writeFile(t, filepath.Join(src, "a.txt"), "changed")
+	report, err = n.Copy(context.Background(), src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 1 || report.Files[0].Path != "a.txt" {
+		t.Errorf("changed file should be copied: %v", report)
+	}
+
+	report, err = n.Copy(context.Background(), filepath.Join(src, "a.txt"), filepath.Join(dir, "single"), opts)
+	if err != nil || report.Copied != 1 {
+		t.Fatalf("copy single file failed: %v %v", report, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "single", "a.txt")); string(b) != "changed" {
+		t.Error("single file not copied")
+	}
+}
+
+func TestNativeMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", filepath.Join("sub", "d.txt")} {
+		writeFile(t, filepath.Join(src, name), name)
+	}
+	writeFile(t, filepath.Join(dst, "desktop.ini"), "ini")
+
+	n := &Native{}
+	opts := Options{FilteredFiles: []string{"*.ini"}, Mirror: true, MaxDeleteRatio: 0.5}
+	if _, err = n.Copy(context.Background(), src, dst, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(filepath.Join(src, "a.txt"))
+	report, err := n.Copy(context.Background(), src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 {
+		t.Errorf("a.txt should be deleted: %v", report)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); !os.IsNotExist(err) {
+		t.Error("a.txt still exists in dst")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "desktop.ini")); err != nil {
+		t.Error("filtered file should not be deleted")
+	}
+
+	os.RemoveAll(filepath.Join(src, "sub"))
+	os.Remove(filepath.Join(src, "b.txt"))
+	if _, err = n.Copy(context.Background(), src, dst, opts); err == nil {
+		t.Error("deleting 2 of 3 files should exceed the max delete ratio")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "sub", "d.txt")); err != nil {
+		t.Error("nothing should be deleted when the max delete ratio is exceeded")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), "a")
+	writeFile(t, filepath.Join(src, "b.txt"), "b")
+
+	report, err := (&Native{}).Copy(context.Background(), src, dst, Options{Verify: true})
+	if err != nil || report.Verified != 2 {
+		t.Fatalf("verify failed: %v %v", report, err)
+	}
+
+	// corrupt the copy without changing size and modification time
+	info, _ := os.Stat(filepath.Join(dst, "b.txt"))
+	writeFile(t, filepath.Join(dst, "b.txt"), "x")
+	os.Chtimes(filepath.Join(dst, "b.txt"), info.ModTime(), info.ModTime())
+	mismatched := Verify(src, dst, []string{"a.txt", "b.txt"})
+	if len(mismatched) != 1 || mismatched[0] != "b.txt" {
+		t.Errorf("b.txt should be mismatched: %v", mismatched)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "b.txt")); !os.IsNotExist(err) {
+		t.Error("mismatched file should be removed")
+	}
+}
+
+func TestNativeWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeFile(t, filepath.Join(src, "a.txt"), "a")
+	writeFile(t, filepath.Join(src, "b.txt"), "b")
+	writeFile(t, filepath.Join(src, "c.txt"), "c")
+
+	calls := 0
+	closed := errors.New("window closed")
+	opts := Options{Wait: func() error {
+		calls++
+		if calls > 2 {
+			return closed
+		}
+		return nil
+	}}
+	report, err := (&Native{}).Copy(context.Background(), src, filepath.Join(dir, "dst"), opts)
+	if err != closed {
+		t.Fatalf("copy should be aborted by Wait, got %v", err)
+	}
+	if report.Copied != 2 {
+		t.Errorf("2 files should be copied before the abort: %v", report)
+	}
+}
+
+func TestNativeProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeFile(t, filepath.Join(src, "a.txt"), "a")
+	writeFile(t, filepath.Join(src, "sub", "b.txt"), "bb")
+
+	var files []string
+	var bytes int64
+	opts := Options{Progress: func(path string, size int64) {
+		files = append(files, path)
+		bytes += size
+	}}
+	for i := 0; i < 2; i++ {
+		files, bytes = nil, 0
+		if _, err = (&Native{}).Copy(context.Background(), src, filepath.Join(dir, "dst"), opts); err != nil {
+			t.Fatal(err)
+		}
+		// unchanged files are reported as well
+		if len(files) != 2 || files[0] != "a.txt" || files[1] != filepath.Join("sub", "b.txt") || bytes != 3 {
+			t.Errorf("run %d progress = %v, %d bytes", i, files, bytes)
+		}
+	}
+}
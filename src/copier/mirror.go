@@ -0,0 +1,101 @@
+package copier
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"values"
+)
+
+// Extraneous walks dst and return the entries (relative to dst) which do not exist in src,
+// the number of files that would be removed with them, and the number of files in dst.
+// Filtered files are neither counted nor removed.
+func Extraneous(src, dst string, filtered []string) (entries []string, deleteCount, total int, err error) {
+	if _, err = os.Stat(dst); os.IsNotExist(err) {
+		return nil, 0, 0, nil
+	}
+	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !info.IsDir() && (IsFiltered(info.Name(), filtered) || isTempFile(info.Name())) {
+			return nil
+		}
+		srcInfo, err := os.Stat(filepath.Join(src, rel))
+		// keep the entries whose source can not be read, they may still exist
+		if (err == nil && srcInfo.IsDir() == info.IsDir()) || (err != nil && !os.IsNotExist(err)) {
+			if !info.IsDir() {
+				total++
+			}
+			return nil
+		}
+		entries = append(entries, rel)
+		count := countFiles(path, info, filtered)
+		deleteCount += count
+		total += count
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return entries, deleteCount, total, err
+}
+
+func countFiles(path string, info os.FileInfo, filtered []string) int {
+	if !info.IsDir() {
+		return 1
+	}
+	count := 0
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !IsFiltered(info.Name(), filtered) {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func isTempFile(name string) bool {
+	return strings.HasSuffix(name, values.TempFileSuffix)
+}
+
+// CheckDeleteRatio return an error if more than maxRatio of total files would be deleted.
+func CheckDeleteRatio(deleteCount, total int, maxRatio float64) error {
+	if total == 0 || deleteCount == 0 {
+		return nil
+	}
+	ratio := float64(deleteCount) / float64(total)
+	if ratio > maxRatio {
+		return fmt.Errorf("mirror would delete %d of %d files (%.0f%%), more than the max delete ratio %.0f%%",
+			deleteCount, total, ratio*100, maxRatio*100)
+	}
+	return nil
+}
+
+// planMirror finds the extraneous entries of dst and checks them against the delete ratio.
+func planMirror(src, dst string, opts Options) ([]string, error) {
+	entries, deleteCount, total, err := Extraneous(src, dst, opts.FilteredFiles)
+	if err != nil {
+		return nil, err
+	}
+	if err = CheckDeleteRatio(deleteCount, total, opts.MaxDeleteRatio); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func removeEntries(dst string, entries []string, report *Report) {
+	for _, entry := range entries {
+		result := FileResult{Path: entry, Status: StatusDeleted}
+		if err := os.RemoveAll(filepath.Join(dst, entry)); err != nil {
+			result.Status = StatusFailed
+			result.Err = err
+		}
+		report.add(result)
+	}
+}
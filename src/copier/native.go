@@ -0,0 +1,170 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"glog"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"util"
+	"values"
+)
+
+// Native is a pure go copier, it copies new and changed files only.
+// A file is considered unchanged if the size and modification time are the same.
+type Native struct{}
+
+func (n *Native) Copy(ctx context.Context, src, dst string, opts Options) (*Report, error) {
+	report := &Report{}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return report, err
+	}
+
+	if fi.Mode().IsRegular() {
+		if !IsFiltered(fi.Name(), opts.FilteredFiles) {
+			if err = opts.wait(ctx); err != nil {
+				return report, err
+			}
+			result := n.copyFile(ctx, src, filepath.Join(dst, fi.Name()), fi.Name(), fi, opts)
+			report.add(result)
+			opts.done(result)
+		}
+	} else if fi.IsDir() {
+		var extraneous []string
+		if opts.Mirror {
+			if extraneous, err = planMirror(src, dst, opts); err != nil {
+				return report, err
+			}
+			// remove first, so a file replaced by a directory with the same name (or the reverse) can be copied
+			removeEntries(dst, extraneous, report)
+		}
+		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			rel, relErr := filepath.Rel(src, path)
+			if relErr != nil {
+				return relErr
+			}
+			if err != nil {
+				// unreadable entries are reported and skipped, the rest of the tree is still copied
+				report.add(FileResult{Path: rel, Status: StatusFailed, Err: err})
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				return os.MkdirAll(filepath.Join(dst, rel), os.ModePerm)
+			}
+			if !info.Mode().IsRegular() || IsFiltered(info.Name(), opts.FilteredFiles) {
+				return nil
+			}
+			if err := opts.wait(ctx); err != nil {
+				return err
+			}
+			result := n.copyFile(ctx, path, filepath.Join(dst, rel), rel, info, opts)
+			report.add(result)
+			opts.done(result)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	} else {
+		return report, errors.New(src + " is neither a file nor a directory.")
+	}
+
+	if err = ctx.Err(); err != nil {
+		return report, err
+	}
+	if report.Failed > 0 {
+		return report, fmt.Errorf("%d files failed", report.Failed)
+	}
+	if opts.Verify {
+		return report, verifyCopy(ctx, src, dst, opts, report, false)
+	}
+	return report, nil
+}
+
+func (n *Native) copyFile(ctx context.Context, src, dst, rel string, srcInfo os.FileInfo, opts Options) FileResult {
+	result := FileResult{Path: rel, Size: srcInfo.Size()}
+	if dstInfo, err := os.Stat(dst); err == nil && SameFile(srcInfo, dstInfo) {
+		result.Status = StatusSkipped
+		return result
+	}
+	if opts.LinkDest != "" {
+		link := filepath.Join(opts.LinkDest, rel)
+		if linkInfo, err := os.Stat(link); err == nil && linkInfo.Mode().IsRegular() && SameFile(srcInfo, linkInfo) {
+			if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err == nil {
+				err = os.Link(link, dst)
+			}
+			if err == nil {
+				result.Status = StatusLinked
+				return result
+			}
+			// fall back to copy, e.g. the file system does not support hard links
+			glog.Warningf("link %s to %s failed, will copy it: %v", dst, link, err)
+		}
+	}
+	if err := CopyFile(ctx, src, dst, srcInfo); err != nil {
+		glog.Errorf("copy %s to %s failed: %v", src, dst, err)
+		result.Status = StatusFailed
+		result.Err = err
+		return result
+	}
+	result.Status = StatusCopied
+	return result
+}
+
+// SameFile report whether the two files have the same size and modification time.
+func SameFile(a, b os.FileInfo) bool {
+	if a.Size() != b.Size() {
+		return false
+	}
+	diff := a.ModTime().Sub(b.ModTime())
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff < values.ModTimeTolerance
+}
+
+// CopyFile copies src to dst through a temporary file, so that an interrupted copy never leaves
+// a half written dst. The permission and modification time of src are kept. The copy stops once ctx is done.
+func CopyFile(ctx context.Context, src, dst string, srcInfo os.FileInfo) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + values.TempFileSuffix
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, srcInfo.Mode().Perm()|0200)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = io.Copy(out, &util.ContextReader{Ctx: ctx, Reader: in}); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmp, time.Now(), srcInfo.ModTime()); err != nil {
+		return err
+	}
+	// os.Rename can not replace a read only file on windows
+	if util.Exists(dst) {
+		os.Chmod(dst, 0666)
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,64 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"glog"
+	"os"
+	"path/filepath"
+	"strings"
+	"util"
+)
+
+// Robocopy copies files with the windows robocopy command.
+// It does not report per-file results, the command output is kept in Report.Output.
+// A failed copy is not retried here, but by the retry policy of the task.
+type Robocopy struct {
+}
+
+func (r *Robocopy) Copy(ctx context.Context, src, dst string, opts Options) (*Report, error) {
+	report := &Report{}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return report, err
+	}
+
+	if opts.LinkDest != "" {
+		return report, errors.New("robocopy does not support linking unchanged files")
+	}
+
+	var args []string
+	if fi.Mode().IsRegular() {
+		args = []string{filepath.Dir(src), dst, filepath.Base(src), "/xf"}
+	} else if fi.IsDir() {
+		if opts.Mirror {
+			// robocopy does the deletion itself, the plan is only used to check the delete ratio
+			if _, err = planMirror(src, dst, opts); err != nil {
+				return report, err
+			}
+			args = []string{src, dst, "/mir", "/xf"}
+		} else {
+			args = []string{src, dst, "/e", "/xf"}
+		}
+	} else {
+		return report, errors.New(src + " is neither a file nor a directory.")
+	}
+	args = append(args, opts.FilteredFiles...)
+
+	// robocopy copies all files in one command, so it can only wait before it starts
+	if err = opts.wait(ctx); err != nil {
+		return report, err
+	}
+
+	report.Output, err = util.DealRobocopyResult(util.RunCommandContext(ctx, "robocopy", args...))
+	if err != nil {
+		glog.Errorf("exec command {robocopy %s} failed: %v\n%v", strings.Join(args, " "), err, report.Output)
+		return report, err
+	}
+	glog.V(3).Infof("exec robocopy: %v", report.Output)
+	if opts.Verify {
+		// robocopy does not tell which files are copied, so all files are verified
+		return report, verifyCopy(ctx, src, dst, opts, report, true)
+	}
+	return report, nil
+}
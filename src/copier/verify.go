@@ -0,0 +1,116 @@
+package copier
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"glog"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// max count of mismatched files in the error message, all of them are logged
+const maxMismatchedInError = 10
+
+// HashFile return the SHA-256 of the file content
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify re-reads the files (relative paths) from srcRoot and dstRoot and return the ones whose SHA-256 differ.
+// The mismatched files are removed from dstRoot, so the next copy does not skip them.
+func Verify(srcRoot, dstRoot string, files []string) (mismatched []string) {
+	for _, rel := range files {
+		srcHash, err := HashFile(filepath.Join(srcRoot, rel))
+		if err != nil {
+			// the source changed or disappeared after the copy, it is not a copy error
+			glog.Warningf("verify: read source %s failed: %v", rel, err)
+			continue
+		}
+		dstPath := filepath.Join(dstRoot, rel)
+		dstHash, err := HashFile(dstPath)
+		if err == nil && dstHash == srcHash {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("verify: read %s failed: %v", dstPath, err)
+		} else {
+			glog.Errorf("verify: %s mismatched, sha256 %s, source sha256 %s", dstPath, dstHash, srcHash)
+		}
+		mismatched = append(mismatched, rel)
+		os.Remove(dstPath)
+	}
+	return mismatched
+}
+
+// MismatchError is the error of a copy which has mismatched files
+func MismatchError(mismatched []string) error {
+	list := mismatched
+	if len(list) > maxMismatchedInError {
+		list = append(list[:maxMismatchedInError:maxMismatchedInError], "...")
+	}
+	return fmt.Errorf("%d files mismatched after copy: %s", len(mismatched), strings.Join(list, ", "))
+}
+
+// verifyCopy verifies the files of report copied in this run, or all files of src if all is set,
+// and records the mismatched files in report
+func verifyCopy(ctx context.Context, src, dst string, opts Options, report *Report, all bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	srcRoot := src
+	if fi.Mode().IsRegular() {
+		srcRoot = filepath.Dir(src)
+	}
+
+	var files []string
+	if !all {
+		for _, f := range report.Files {
+			if f.Status == StatusCopied {
+				files = append(files, f.Path)
+			}
+		}
+	} else if fi.Mode().IsRegular() {
+		if !IsFiltered(fi.Name(), opts.FilteredFiles) {
+			files = append(files, fi.Name())
+		}
+	} else {
+		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || IsFiltered(info.Name(), opts.FilteredFiles) {
+				return nil
+			}
+			rel, err := filepath.Rel(src, path)
+			files = append(files, rel)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	report.Verified = len(files)
+	report.Mismatched = Verify(srcRoot, dst, files)
+	if len(report.Mismatched) > 0 {
+		return MismatchError(report.Mismatched)
+	}
+	return nil
+}
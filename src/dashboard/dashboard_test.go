@@ -0,0 +1,28 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodGet, "/index.html", http.StatusNotFound},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("%s %s = %d, want %d", c.method, c.path, w.Code, c.code)
+		}
+		if c.code == http.StatusOK && !strings.Contains(w.Body.String(), "/api/tasks") {
+			t.Errorf("%s %s should serve the page using the api", c.method, c.path)
+		}
+	}
+}
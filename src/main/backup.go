@@ -1,31 +1,171 @@
 package main
 
 import (
+	"context"
+	"control"
+	"copier"
+	"dashboard"
 	"errors"
 	"flag"
+	"fmt"
 	"glog"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"repository"
+	"restore"
+	"schedule"
+	"snapshot"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
 	"util"
 	"values"
+	"watch"
 	"yaml.v2"
 )
 
 var BackupStatusCh chan string
+// the cause of cancelling the runs when the daemon shuts down
+var errShutdown = errors.New("backup process is shutting down")
+// the queue of task runs, limited by max_concurrent_tasks
+var TaskQueue = schedule.NewQueue(0)
 var FilterFiles []string
+// the directory of the config and status files, <home>/Documents/backup if empty
+var configDir string
+
+// exit codes of the backup process
+const (
+	// the command succeeded, or the daemon shut down after all runs in progress finished
+	ExitOK = 0
+	// the command failed or was misused
+	ExitFailed = 1
+	// shut down with runs interrupted, as they did not finish in the shutdown grace period
+	ExitInterrupted = 2
+)
+
+// backup modes
+const (
+	// copy new and changed files to dst, files deleted from src are kept in dst
+	ModeCopy = "copy"
+	// like copy, and remove the files of dst that no longer exist in src
+	ModeMirror = "mirror"
+	// every run creates a timestamped snapshot under dst, unchanged files are hard linked to the previous snapshot
+	ModeSnapshot = "snapshot"
+)
+
+// what a running task does when its window closes
+const (
+	// keep running until the task finishes
+	WindowCloseContinue = "continue"
+	// pause before the next file, resume when a window opens
+	WindowClosePause = "pause"
+	// stop before the next file, the run fails
+	WindowCloseAbort = "abort"
+)
+
+// what starts a run of a task
+const (
+	// the period or schedule
+	TriggerPeriod = "period"
+	// changes of the files of src, the period or schedule is used if src can not be watched
+	TriggerWatch = "watch"
+)
+
+// dst formats
+const (
+	// files are stored as plain copies
+	FormatFiles = "files"
+	// files are stored in a deduplicating repository under dst, every run is a snapshot
+	FormatRepository = "repository"
+)
 
 type BackupConfig struct {
 	DefaultDst    string `yaml:"default_dst"`
 	DefaultPeriod string `yaml:"default_period"`
 	DefaultFilteredFiles []string `yaml:"default_filtered_file"`
+	DefaultRetention *snapshot.Retention `yaml:"default_retention"`
+	// the file holding the passphrase of encrypted tasks
+	KeyFile string `yaml:"key_file"`
+	// the time zone of task schedules, the local one if empty
+	TimeZone string `yaml:"time_zone"`
+	// the default time windows tasks are allowed to run in
+	Windows []string `yaml:"windows"`
+	// the max number of tasks running at the same time, 0 means no limit
+	MaxConcurrentTasks int `yaml:"max_concurrent_tasks"`
+	// the max random delay before each run, in the same format as period
+	StartJitter string `yaml:"start_jitter"`
+	// the max wait for runs in progress to finish when the daemon shuts down, in the same format as period
+	ShutdownGrace string `yaml:"shutdown_grace"`
+	shutdownGrace time.Duration
+	// the control endpoint of the daemon, used by the commands
+	Control *ControlConfig `yaml:"control"`
 	Tasks         []Task `yaml:"tasks"`
 }
 
 func (bc *BackupConfig) Validate() (err error) {
+	if bc.MaxConcurrentTasks < 0 {
+		err = errors.New("max_concurrent_tasks should not be negative")
+		glog.Error(err.Error())
+		return err
+	}
+	bc.shutdownGrace = values.DefaultShutdownGrace
+	if bc.ShutdownGrace != "" {
+		if bc.shutdownGrace, err = util.ParseDuration(bc.ShutdownGrace); err != nil {
+			err = errors.New("invalid shutdown_grace: " + err.Error())
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	if bc.Control != nil && bc.Control.Address != "" {
+		if err = control.CheckAddress(bc.Control.Address); err != nil {
+			err = errors.New("invalid control address " + bc.Control.Address + ": " + err.Error())
+			glog.Error(err.Error())
+			return err
+		}
+		if bc.Control.Token == "" {
+			err = errors.New("control token is required with control address")
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	if bc.Control != nil && bc.Control.RestoreRoot != "" && !filepath.IsAbs(bc.Control.RestoreRoot) {
+		err = errors.New("control restore_root " + bc.Control.RestoreRoot + " should be an absolute path")
+		glog.Error(err.Error())
+		return err
+	}
+	if bc.Control != nil && bc.Control.HTTPAddress != "" {
+		if _, _, err = net.SplitHostPort(bc.Control.HTTPAddress); err != nil {
+			err = errors.New("invalid control http_address " + bc.Control.HTTPAddress + ": " + err.Error())
+			glog.Error(err.Error())
+			return err
+		}
+		// without the token the api only accepts requests of localhost, and refuses the ones of other web sites
+		if control.CheckAddress(bc.Control.HTTPAddress) != nil && bc.Control.Token == "" {
+			err = errors.New("control token is required with http_address not on localhost")
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	var startJitter time.Duration
+	if bc.StartJitter != "" {
+		if startJitter, err = util.ParseDuration(bc.StartJitter); err != nil {
+			err = errors.New("invalid start_jitter: " + err.Error())
+			glog.Error(err.Error())
+			return err
+		}
+	}
+
 	for index, task := range bc.Tasks {
 		bc.Tasks[index].Src = filepath.Clean(task.Src)
 		bc.Tasks[index].Dst = filepath.Clean(task.Dst)
@@ -46,7 +186,25 @@ func (bc *BackupConfig) Validate() (err error) {
 			}
 		}
 
-		if strings.EqualFold(task.PeriodString, "") {
+		var loc *time.Location
+		if loc, err = task.location(bc.TimeZone); err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		bc.Tasks[index].loc = loc
+
+		if len(task.After) > 0 {
+			if task.Schedule != "" || task.PeriodString != "" {
+				err = errors.New(task.Name + " a task with after runs when its prerequisites succeed, it can not have period or schedule")
+				glog.Error(err.Error())
+				return err
+			}
+		} else if task.Schedule != "" {
+			if err = bc.Tasks[index].parseSchedule(loc); err != nil {
+				glog.Error(err.Error())
+				return err
+			}
+		} else if strings.EqualFold(task.PeriodString, "") {
 			if bc.DefaultPeriod != "" {
 				bc.Tasks[index].PeriodString = bc.DefaultPeriod
 			} else {
@@ -56,180 +214,2251 @@ func (bc *BackupConfig) Validate() (err error) {
 			}
 		}
 
+		bc.Tasks[index].startJitter = startJitter
+
+		if task.Timeout != "" {
+			if bc.Tasks[index].timeout, err = util.ParseDuration(task.Timeout); err != nil {
+				err = errors.New(task.Name + " invalid timeout: " + err.Error())
+				glog.Error(err.Error())
+				return err
+			}
+		}
+
+		if task.Retry != nil {
+			if err = task.Retry.parse(); err != nil {
+				err = errors.New(task.Name + " invalid retry: " + err.Error())
+				glog.Error(err.Error())
+				return err
+			}
+		}
+
+		switch strings.ToLower(task.Trigger) {
+		case "", TriggerPeriod:
+			bc.Tasks[index].Trigger = TriggerPeriod
+		case TriggerWatch:
+			bc.Tasks[index].Trigger = TriggerWatch
+			if len(task.After) > 0 {
+				err = errors.New(task.Name + " watch trigger can not be used with after")
+				glog.Error(err.Error())
+				return err
+			}
+			if task.Watch == nil {
+				bc.Tasks[index].Watch = &WatchConfig{}
+			}
+			if err = bc.Tasks[index].Watch.parse(); err != nil {
+				err = errors.New(task.Name + " invalid watch: " + err.Error())
+				glog.Error(err.Error())
+				return err
+			}
+		default:
+			err = errors.New(task.Name + " invalid trigger " + task.Trigger)
+			glog.Error(err.Error())
+			return err
+		}
+
+		if len(task.Windows) == 0 {
+			bc.Tasks[index].Windows = bc.Windows
+		}
+		if bc.Tasks[index].windows, err = schedule.ParseWindows(bc.Tasks[index].Windows, loc); err != nil {
+			err = errors.New(task.Name + " " + err.Error())
+			glog.Error(err.Error())
+			return err
+		}
+		switch strings.ToLower(task.WindowClose) {
+		case "", WindowCloseContinue:
+			bc.Tasks[index].WindowClose = WindowCloseContinue
+		case WindowClosePause, WindowCloseAbort:
+			bc.Tasks[index].WindowClose = strings.ToLower(task.WindowClose)
+			if bc.Tasks[index].windows == nil {
+				err = errors.New(task.Name + " window_close needs windows")
+				glog.Error(err.Error())
+				return err
+			}
+			if strings.EqualFold(task.Engine, copier.EngineRobocopy) {
+				err = errors.New(task.Name + " window_close " + task.WindowClose + " is not supported by robocopy engine")
+				glog.Error(err.Error())
+				return err
+			}
+		default:
+			err = errors.New(task.Name + " invalid window_close " + task.WindowClose)
+			glog.Error(err.Error())
+			return err
+		}
+
 		if len(bc.DefaultFilteredFiles) > 0 {
 			bc.Tasks[index].FilteredFiles = append(bc.Tasks[index].FilteredFiles, bc.DefaultFilteredFiles...)
 		}
-
-		if strings.EqualFold(task.Name, "") {
-			bc.Tasks[index].Name = "[" + bc.Tasks[index].Src + "-->" + bc.Tasks[index].Dst + "]"
+
+		if _, err = copier.New(task.Engine); err != nil {
+			glog.Error(task.Name + " " + err.Error())
+			return err
+		}
+
+		switch strings.ToLower(task.Mode) {
+		case "":
+			bc.Tasks[index].Mode = ModeCopy
+		case ModeCopy, ModeMirror, ModeSnapshot:
+			bc.Tasks[index].Mode = strings.ToLower(task.Mode)
+		default:
+			err = errors.New(task.Name + " invalid mode " + task.Mode)
+			glog.Error(err.Error())
+			return err
+		}
+
+		switch strings.ToLower(task.Format) {
+		case "", FormatFiles:
+			bc.Tasks[index].Format = FormatFiles
+		case FormatRepository:
+			bc.Tasks[index].Format = FormatRepository
+			if task.Mode == "" {
+				bc.Tasks[index].Mode = ModeSnapshot
+			} else if bc.Tasks[index].Mode != ModeSnapshot {
+				err = errors.New(task.Name + " repository format only supports snapshot mode")
+				glog.Error(err.Error())
+				return err
+			}
+		default:
+			err = errors.New(task.Name + " invalid format " + task.Format)
+			glog.Error(err.Error())
+			return err
+		}
+
+		if _, _, _, err = task.Chunking.Sizes(); err != nil {
+			err = errors.New(task.Name + " invalid chunking: " + err.Error())
+			glog.Error(err.Error())
+			return err
+		}
+
+		if err = task.Compression.Validate(); err != nil {
+			err = errors.New(task.Name + " invalid compression: " + err.Error())
+			glog.Error(err.Error())
+			return err
+		}
+		if task.Compression.Enabled() && bc.Tasks[index].Format != FormatRepository {
+			err = errors.New(task.Name + " compression is only supported by repository format")
+			glog.Error(err.Error())
+			return err
+		}
+
+		if task.Encrypt {
+			if bc.Tasks[index].Format != FormatRepository {
+				err = errors.New(task.Name + " encryption is only supported by repository format")
+				glog.Error(err.Error())
+				return err
+			}
+			if bc.KeyFile == "" {
+				err = errors.New(task.Name + " key_file is required for encryption")
+				glog.Error(err.Error())
+				return err
+			}
+			bc.Tasks[index].keyFile = filepath.Clean(bc.KeyFile)
+		}
+
+		if task.ParityPercent < 0 || task.ParityPercent > 100 {
+			err = errors.New(task.Name + " parity_percent should be between 0 and 100")
+			glog.Error(err.Error())
+			return err
+		}
+		if task.ParityPercent > 0 && bc.Tasks[index].Format != FormatRepository {
+			err = errors.New(task.Name + " parity is only supported by repository format")
+			glog.Error(err.Error())
+			return err
+		}
+
+		if task.Check != nil {
+			if bc.Tasks[index].Format != FormatRepository {
+				err = errors.New(task.Name + " check is only supported by repository format")
+				glog.Error(err.Error())
+				return err
+			}
+			if task.Check.periodDuration, err = util.ParseDuration(task.Check.Period); err != nil {
+				err = errors.New(task.Name + " invalid check period: " + err.Error())
+				glog.Error(err.Error())
+				return err
+			}
+			if task.Check.ReadPercent < 0 || task.Check.ReadPercent > 100 {
+				err = errors.New(task.Name + " check read_percent should be between 0 and 100")
+				glog.Error(err.Error())
+				return err
+			}
+		}
+
+		if bc.Tasks[index].Mode == ModeSnapshot && strings.EqualFold(task.Engine, copier.EngineRobocopy) {
+			err = errors.New(task.Name + " snapshot mode is not supported by robocopy engine")
+			glog.Error(err.Error())
+			return err
+		}
+
+		// only snapshots are pruned, the latest version of copy and mirror mode is never removed
+		versioned := bc.Tasks[index].Mode == ModeSnapshot || bc.Tasks[index].Format == FormatRepository
+		if task.Retention != nil && !versioned {
+			err = errors.New(task.Name + " retention is only supported by snapshot mode or repository format")
+			glog.Error(err.Error())
+			return err
+		}
+		if task.Retention == nil && versioned {
+			bc.Tasks[index].Retention = bc.DefaultRetention
+		}
+		if bc.Tasks[index].Retention != nil {
+			if err = bc.Tasks[index].Retention.Validate(); err != nil {
+				err = errors.New(task.Name + " " + err.Error())
+				glog.Error(err.Error())
+				return err
+			}
+		}
+
+		if task.MaxDeleteRatio == 0 {
+			bc.Tasks[index].MaxDeleteRatio = values.DefaultMaxDeleteRatio
+		} else if task.MaxDeleteRatio < 0 || task.MaxDeleteRatio > 1 {
+			err = errors.New(task.Name + " max_delete_ratio should be between 0 and 1")
+			glog.Error(err.Error())
+			return err
+		}
+
+		if strings.EqualFold(task.Name, "") {
+			bc.Tasks[index].Name = "[" + bc.Tasks[index].Src + "-->" + bc.Tasks[index].Dst + "]"
+		}
+	}
+	if err = bc.validateRepositoryTasks(); err != nil {
+		return err
+	}
+	return bc.validateDependencies()
+}
+
+// validateRepositoryTasks checks that the tasks backing up to the same repository keep their snapshots apart
+func (bc *BackupConfig) validateRepositoryTasks() error {
+	for i := range bc.Tasks {
+		for j := 0; j < i; j++ {
+			a, b := &bc.Tasks[j], &bc.Tasks[i]
+			if a.Format != FormatRepository || b.Format != FormatRepository ||
+				!strings.EqualFold(filepath.Clean(a.Dst), filepath.Clean(b.Dst)) || !repository.SameTaskDir(a.Name, b.Name) {
+				continue
+			}
+			err := errors.New(b.Name + " and " + a.Name + " back up to the same repository, their names should differ " +
+				"in more than case and special characters")
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDependencies checks that the prerequisites in after exist and do not form a cycle
+func (bc *BackupConfig) validateDependencies() (err error) {
+	// index of each prerequisite of each task
+	prerequisites := make([][]int, len(bc.Tasks))
+	for i, task := range bc.Tasks {
+		for _, name := range task.After {
+			found := -1
+			for j := range bc.Tasks {
+				if !strings.EqualFold(bc.Tasks[j].Name, name) {
+					continue
+				}
+				if found >= 0 {
+					err = errors.New(task.Name + " after " + name + ": more than one task is named " + name)
+					glog.Error(err.Error())
+					return err
+				}
+				found = j
+			}
+			if found < 0 {
+				err = errors.New(task.Name + " after " + name + ": no such task")
+				glog.Error(err.Error())
+				return err
+			}
+			prerequisites[i] = append(prerequisites[i], found)
+		}
+	}
+
+	// depth first search, a task met again on the current path closes a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(bc.Tasks))
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return errors.New("task dependencies form a cycle: " + strings.Join(append(path, bc.Tasks[i].Name), " -> "))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		path = append(path, bc.Tasks[i].Name)
+		for _, j := range prerequisites[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range bc.Tasks {
+		if err = visit(i); err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+type ControlConfig struct {
+	// the unix socket, backup.sock beside backup.yaml if empty
+	Socket string `yaml:"socket"`
+	// an optional tcp address on localhost, like 127.0.0.1:7300
+	Address string `yaml:"address"`
+	// an optional http address of the REST api, like 127.0.0.1:7301
+	HTTPAddress string `yaml:"http_address"`
+	// the token clients of the tcp and http addresses must send
+	Token string `yaml:"token"`
+	// the directory the control endpoint may restore into besides the src of the task, like a restore folder
+	RestoreRoot string `yaml:"restore_root"`
+}
+
+type Task struct {
+	Src            string `yaml:"src"`
+	Dst            string `yaml:"dst"`
+	PeriodString   string `yaml:"period"`
+	PeriodDuration time.Duration
+	// cron expression of the run times, used instead of period
+	Schedule       string `yaml:"schedule"`
+	TimeZone       string `yaml:"time_zone"`
+	schedule       *schedule.Cron
+	loc            *time.Location
+	// time windows the task is allowed to run in, and what to do when they close
+	Windows        []string `yaml:"windows"`
+	WindowClose    string   `yaml:"window_close"`
+	windows        *schedule.Windows
+	// tasks of higher priority get a free slot of TaskQueue first
+	Priority       int `yaml:"priority"`
+	startJitter    time.Duration
+	// names of the tasks that must succeed before the task runs, instead of period or schedule
+	After          []string `yaml:"after"`
+	// the prerequisites waited for, set when the task starts
+	prerequisites  *prerequisites
+	// the requests of the control endpoint, set when the task starts
+	control        *taskControl
+	Trigger        string `yaml:"trigger"`
+	Watch          *WatchConfig `yaml:"watch"`
+	Retry          *RetryConfig `yaml:"retry"`
+	Name           string `yaml:"name"`
+	// cancelled when the task is stopped, which interrupts its runs in progress
+	runCtx         context.Context
+	cancel         context.CancelCauseFunc
+	// cancelled when the task stops starting runs, as it is stopped or replaced by the modified task
+	ctx            context.Context
+	retire         context.CancelCauseFunc
+	// the runs of the task in progress, the modified task starts once they finished
+	runs           *runCounter
+	// the max duration of a run, no limit if empty
+	Timeout        string `yaml:"timeout"`
+	timeout        time.Duration
+	LastSuccTime   time.Time `yaml:"last_succ_time"`
+	RecentResult   []string  `yaml:"recent_result"`
+	// the result and the copy engine output of the last failed run
+	LastError      string    `yaml:"last_error"`
+	FilteredFiles  []string  `yaml:"filtered_files"`
+	Engine         string    `yaml:"engine"`
+	Mode           string    `yaml:"mode"`
+	MaxDeleteRatio float64   `yaml:"max_delete_ratio"`
+	Retention      *snapshot.Retention `yaml:"retention"`
+	Format         string    `yaml:"format"`
+	Chunking       *repository.Chunking `yaml:"chunking"`
+	Compression    *repository.Compression `yaml:"compression"`
+	Encrypt        bool      `yaml:"encrypt"`
+	Verify         bool      `yaml:"verify"`
+	ParityPercent  int       `yaml:"parity_percent"`
+	Check          *CheckConfig `yaml:"check"`
+	LastCheckTime     time.Time `yaml:"last_check_time"`
+	RecentCheckResult []string  `yaml:"recent_check_result"`
+	keyFile        string
+	// the lock held by the runs of the task, so it never runs in two backup processes at once, no lock if empty
+	lockFile string
+	// details of the current run, recorded with its result
+	runNote string
+	// the errors or output of the copy engine of the current run, recorded if it fails
+	runOutput string
+	// guards the status fields above of a started task, LastSuccTime to runOutput, which its runs write while
+	// the status file and the control endpoint read them. It is nil for tasks not started by the daemon.
+	statusMu *sync.Mutex
+}
+
+// CheckConfig schedules integrity checks of the repository of a task
+type CheckConfig struct {
+	// the check period, in the same format as the task period
+	Period         string  `yaml:"period"`
+	periodDuration time.Duration
+	// the percentage (0 ~ 100) of blobs re-read in each check
+	ReadPercent float64 `yaml:"read_percent"`
+}
+
+// location return the time zone of the task, or defaultZone if it has none
+func (t *Task) location(defaultZone string) (*time.Location, error) {
+	zone := t.TimeZone
+	if zone == "" {
+		zone = defaultZone
+	}
+	if zone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, errors.New(t.Name + " invalid time zone " + zone + ": " + err.Error())
+	}
+	return loc, nil
+}
+
+// parseSchedule parses the schedule of the task in loc
+func (t *Task) parseSchedule(loc *time.Location) error {
+	sched, err := schedule.ParseCron(t.Schedule, loc)
+	if err != nil {
+		return errors.New(t.Name + " " + err.Error())
+	}
+	if sched.Next(time.Now()).IsZero() {
+		return errors.New(t.Name + " schedule " + t.Schedule + " never runs")
+	}
+	t.schedule = sched
+	return nil
+}
+
+// WatchConfig is the debounce of a task with watch trigger
+type WatchConfig struct {
+	// the run starts once no change came for the quiet period
+	QuietPeriod string `yaml:"quiet_period"`
+	quietPeriod time.Duration
+	// but at most max delay after the first change
+	MaxDelay string `yaml:"max_delay"`
+	maxDelay time.Duration
+}
+
+func (w *WatchConfig) parse() (err error) {
+	w.quietPeriod, w.maxDelay = values.DefaultWatchQuietPeriod, values.DefaultWatchMaxDelay
+	if w.QuietPeriod != "" {
+		if w.quietPeriod, err = util.ParseDuration(w.QuietPeriod); err != nil {
+			return err
+		}
+	}
+	if w.MaxDelay != "" {
+		if w.maxDelay, err = util.ParseDuration(w.MaxDelay); err != nil {
+			return err
+		}
+	}
+	if w.maxDelay < w.quietPeriod {
+		return errors.New("max_delay should not be less than quiet_period")
+	}
+	return nil
+}
+
+// RetryConfig retries a failed run, before waiting for the next period or schedule
+type RetryConfig struct {
+	// the max number of runs, including the failed one
+	MaxAttempts int `yaml:"max_attempts"`
+	// the wait before the first retry, in the same format as period
+	InitialDelay string `yaml:"initial_delay"`
+	// each retry waits longer than the previous one by the factor
+	BackoffFactor float64 `yaml:"backoff_factor"`
+	// the max wait before a retry, no limit if empty
+	MaxDelay string `yaml:"max_delay"`
+	policy   util.RetryPolicy
+}
+
+func (r *RetryConfig) parse() (err error) {
+	if r.MaxAttempts < 1 {
+		return errors.New("max_attempts should be at least 1")
+	}
+	r.policy = util.RetryPolicy{MaxAttempts: r.MaxAttempts, InitialDelay: values.DefaultRetryDelay,
+		Factor: r.BackoffFactor}
+	if r.InitialDelay != "" {
+		if r.policy.InitialDelay, err = util.ParseDuration(r.InitialDelay); err != nil {
+			return err
+		}
+	}
+	if r.BackoffFactor == 0 {
+		r.policy.Factor = values.RetryBackoffFactor
+	} else if r.BackoffFactor < 1 {
+		return errors.New("backoff_factor should not be less than 1")
+	}
+	if r.MaxDelay != "" {
+		if r.policy.MaxDelay, err = util.ParseDuration(r.MaxDelay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Task) check() (err error) {
+	if !util.Exists(t.Src) {
+		err = errors.New(t.Src + " does not exist, will skip the task " + t.Name)
+		glog.Error(err.Error())
+		return err
+	}
+
+	if !util.Exists(t.Dst) {
+		glog.Warning(t.Dst + " does not exist, will create it.")
+		if err = os.Mkdir(t.Dst, os.ModePerm); err != nil {
+			glog.Error("make directory " + t.Dst + " failed: " + err.Error())
+			return err
+		}
+	}
+
+	fi, err := os.Stat(t.Dst)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	if fi.Mode().IsRegular() {
+		err = errors.New("dst directory " + t.Dst + " is regular file!")
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+// lockStatus locks the status fields of the task, and return the function to unlock them
+func (t *Task) lockStatus() func() {
+	if t.statusMu == nil {
+		return func() {}
+	}
+	t.statusMu.Lock()
+	return t.statusMu.Unlock
+}
+
+// copy return a copy of the task, with its status at the moment
+func (t *Task) copy() Task {
+	defer t.lockStatus()()
+	return *t
+}
+
+// setRunNote sets the note of the current run
+func (t *Task) setRunNote(note string) {
+	defer t.lockStatus()()
+	t.runNote = note
+}
+
+// setRunOutput sets the output of the current run
+func (t *Task) setRunOutput(output string) {
+	defer t.lockStatus()()
+	t.runOutput = output
+}
+
+func (t *Task) dealResult(ctx context.Context, err *error) {
+	unlock := t.lockStatus()
+	currTime := time.Now()
+	result := ""
+	if *err == nil {
+		t.LastSuccTime = currTime
+		result = "success"
+		if t.runNote != "" {
+			result += ": " + t.runNote
+		}
+	} else if ctx.Err() == context.DeadlineExceeded {
+		result = "timeout: not finished in " + t.Timeout
+	} else if ctx.Err() == context.Canceled && context.Cause(ctx) == errShutdown {
+		result = "interrupted"
+	} else if ctx.Err() == context.Canceled {
+		result = "cancelled"
+	} else {
+		result = "fail: " + (*err).Error()
+	}
+
+	record := []string{currTime.Format("2006-01-02 15:04:05") + " " + result}
+
+	if len(t.RecentResult) >= values.RecentRecordCount {
+		t.RecentResult = append(record, t.RecentResult[0:values.RecentRecordCount-1]...)
+	} else {
+		t.RecentResult = append(record, t.RecentResult...)
+	}
+	if *err != nil {
+		output := t.runOutput
+		if len(output) > values.MaxErrorOutput {
+			output = "...\n" + output[len(output)-values.MaxErrorOutput:]
+		}
+		t.LastError = strings.TrimSpace(record[0] + "\n" + output)
+	}
+	unlock()
+
+	BackupStatusCh <- "update status"
+}
+
+// work runs the task once, it stops once ctx is done
+func (t *Task) work(ctx context.Context) (err error) {
+	defer t.dealResult(ctx, &err)
+	t.setRunNote("")
+	t.setRunOutput("")
+	glog.Infof("start work for task %v", t.Name)
+	if t.lockFile != "" {
+		var lock *util.FileLock
+		if lock, err = t.lock(); err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		defer lock.Unlock()
+	}
+	if err = t.check(); err != nil {
+		glog.Error("task check error: " + err.Error() + ", task name: " + t.Name)
+		return err
+	}
+
+	c, err := copier.New(t.Engine)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+
+	fi, err := os.Stat(t.Src)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	if !fi.Mode().IsRegular() && !fi.Mode().IsDir() {
+		err = errors.New(t.Src + "is neither a file nor a directory.")
+		glog.Error(err.Error())
+		return err
+	}
+
+	if t.Format == FormatRepository {
+		return t.backupToRepository(ctx)
+	}
+
+	opts := copier.Options{
+		FilteredFiles:  t.FilteredFiles,
+		Mirror:         t.Mode == ModeMirror,
+		MaxDeleteRatio: t.MaxDeleteRatio,
+		Verify:         t.Verify,
+		Wait:           t.copyWait(ctx),
+		Progress:       t.copyProgress(),
+	}
+	var report *copier.Report
+	var dst string
+	if t.Mode == ModeSnapshot {
+		var snap *snapshot.Snapshot
+		snap, err = snapshot.Create(t.snapshotRoot(), time.Now(), func(dir string, prev *snapshot.Snapshot) error {
+			dst = dir
+			if prev != nil {
+				opts.LinkDest = prev.Path
+			}
+			var copyErr error
+			report, copyErr = c.Copy(ctx, t.Src, dir, opts)
+			return copyErr
+		})
+		if snap != nil {
+			dst = snap.Path
+		}
+	} else if fi.Mode().IsRegular() {
+		// if src is a regular file, just copy it to dst
+		dst = t.Dst
+		report, err = c.Copy(ctx, t.Src, dst, opts)
+	} else {
+		dst = filepath.Join(t.Dst, filepath.Base(t.Src))
+		report, err = c.Copy(ctx, t.Src, dst, opts)
+	}
+
+	if report == nil {
+		report = &copier.Report{}
+	}
+	output := report.Output
+	for _, f := range report.Files {
+		if f.Err != nil {
+			glog.Errorf("task %v: %s %s: %v", t.Name, f.Status, f.Path, f.Err)
+			if report.Output == "" {
+				output += fmt.Sprintf("%s %s: %v\n", f.Status, f.Path, f.Err)
+			}
+		} else {
+			glog.V(3).Infof("task %v: %s %s", t.Name, f.Status, f.Path)
+		}
+	}
+	t.setRunOutput(output)
+	if err != nil {
+		glog.Errorf("copy %s to %s failed: %v", t.Src, dst, err)
+		return err
+	}
+	glog.Infof("task %v finished: %v", t.Name, report)
+
+	if t.Mode == ModeSnapshot && t.Retention != nil {
+		// a failed prune does not fail the backup itself
+		if _, pruneErr := snapshot.Prune(t.snapshotRoot(), t.Retention, time.Now()); pruneErr != nil {
+			glog.Errorf("task %v prune snapshots failed: %v", t.Name, pruneErr)
+		}
+	}
+
+	return nil
+}
+
+func (t *Task) backupToRepository(ctx context.Context) error {
+	r, err := t.repository()
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	opts := repository.BackupOptions{
+		FilteredFiles: t.FilteredFiles,
+		Chunking:      t.Chunking,
+		Compression:   t.Compression,
+		Verify:        t.Verify,
+		ParityPercent: t.ParityPercent,
+		Wait:          t.copyWait(ctx),
+		Progress:      t.copyProgress(),
+	}
+	manifest, stats, err := r.Backup(ctx, t.Name, t.Src, opts, time.Now())
+	if stats != nil {
+		t.setRunOutput(strings.Join(append(stats.Errors, stats.Mismatched...), "\n"))
+	}
+	if err != nil {
+		glog.Errorf("backup %s to repository %s failed: %v", t.Src, r.Root, err)
+		return err
+	}
+	glog.Infof("task %v finished: snapshot %v, %d files (%d unchanged), %d bytes, %d new blobs of %d bytes",
+		t.Name, manifest.Time.Format(snapshot.TimeFormat), stats.Files, stats.Unchanged, stats.Bytes,
+		stats.NewBlobs, stats.StoredBytes)
+	if stats.WrittenBytes > 0 && t.Compression.Enabled() {
+		note := fmt.Sprintf("compression ratio %.2f", stats.CompressionRatio())
+		t.setRunNote(note)
+		glog.Infof("task %v new blobs compressed to %d bytes, %s", t.Name, stats.WrittenBytes, note)
+	}
+
+	if t.Retention != nil {
+		if _, pruneErr := r.Prune(t.Name, t.Retention, time.Now()); pruneErr != nil {
+			glog.Errorf("task %v prune snapshots failed: %v", t.Name, pruneErr)
+		}
+	}
+	return nil
+}
+
+// lock takes the lock of the task, it fails if the task is running in another backup process
+func (t *Task) lock() (*util.FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(t.lockFile), os.ModePerm); err != nil {
+		return nil, err
+	}
+	lock, err := util.LockFile(t.lockFile)
+	if err == util.ErrLocked {
+		return nil, errors.New("task " + t.Name + " is running in another backup process")
+	}
+	return lock, err
+}
+
+// repository opens the repository of the task, which is shared by all tasks with the same dst
+func (t *Task) repository() (*repository.Repository, error) {
+	var passphrase []byte
+	if t.Encrypt {
+		var err error
+		if passphrase, err = repository.ReadKeyFile(t.keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return repository.Open(filepath.Join(t.Dst, values.RepositoryDirName), passphrase)
+}
+
+// snapshotRoot is the directory that holds the snapshots of the task
+func (t *Task) snapshotRoot() string {
+	return filepath.Join(t.Dst, filepath.Base(t.Src))
+}
+
+func (t *Task) start() {
+	glog.Infof("start task %v", t.Name)
+	if t.Check != nil {
+		name := "check of task " + t.Name
+		go runPeriodically(name, t.LastCheckTime, t.Check.periodDuration, t.ctx.Done(), nil, func() bool {
+			return t.run(name, false, t.runCheck)
+		})
+	}
+	name := "task " + t.Name
+	run := func() bool {
+		return t.runWithRetry(name, t.control.takeTriggered(), func() error {
+			if t.prerequisites != nil {
+				t.prerequisites.reset()
+			}
+			ctx, cancel := t.runContext()
+			defer cancel()
+			err := t.work(ctx)
+			if err == nil {
+				RunningTasks.succeeded(t.Name)
+			} else {
+				RunningTasks.failed(t.Name)
+			}
+			return err
+		})
+	}
+	if t.prerequisites != nil {
+		runTriggered(name, t.ctx.Done(), t.control.trigger, t.prerequisites.ready, run)
+		return
+	}
+	if t.Trigger == TriggerWatch {
+		t.runWatched(name, run)
+		return
+	}
+	t.runByTime(name, run)
+}
+
+// runByTime calls run by the schedule, or the period if the task has no schedule
+func (t *Task) runByTime(name string, run func() bool) {
+	last := t.copy().LastSuccTime
+	if t.schedule != nil {
+		runScheduled(name, last, t.schedule, t.ctx.Done(), t.control.trigger, run)
+		return
+	}
+	runPeriodically(name, last, t.PeriodDuration, t.ctx.Done(), t.control.trigger, run)
+}
+
+// overdue report whether a run by the schedule or period was missed since the last success
+func (t *Task) overdue(now time.Time) bool {
+	if t.schedule != nil {
+		return !t.schedule.Next(t.LastSuccTime).After(now)
+	}
+	return now.Sub(t.LastSuccTime) > t.PeriodDuration
+}
+
+// nextRun return the time of the next run by the schedule or period, which is now if a run was missed.
+// It return zero time for the tasks run after other tasks, or on changes.
+func (t *Task) nextRun(now time.Time) time.Time {
+	if len(t.After) > 0 {
+		return time.Time{}
+	}
+	if t.overdue(now) {
+		return now
+	}
+	if t.Trigger == TriggerWatch {
+		return time.Time{}
+	}
+	if t.schedule != nil {
+		return t.schedule.Next(t.LastSuccTime)
+	}
+	return t.LastSuccTime.Add(t.PeriodDuration)
+}
+
+// when describes what starts the runs of the task
+func (t *Task) when() string {
+	if len(t.After) > 0 {
+		return "after " + strings.Join(t.After, ", ")
+	}
+	if t.Trigger == TriggerWatch {
+		return "on change"
+	}
+	if t.schedule != nil {
+		return "at " + t.Schedule
+	}
+	return "every " + t.PeriodString
+}
+
+// status return the status of the task, the state is empty if the task is not started
+func (t *Task) status(now time.Time) control.TaskStatus {
+	status := control.TaskStatus{
+		Name:              t.Name,
+		LastSuccTime:      t.LastSuccTime,
+		NextRun:           t.nextRun(now),
+		RecentResult:      t.RecentResult,
+		LastError:         t.LastError,
+		LastCheckTime:     t.LastCheckTime,
+		RecentCheckResult: t.RecentCheckResult,
+	}
+	if t.control != nil {
+		status.State = t.control.state()
+		status.Progress = t.control.currentProgress()
+		if status.State == control.StatePaused {
+			status.NextRun = time.Time{}
+		}
+	}
+	return status
+}
+
+// runWatched calls run when the files of src changed and settled, see watch.Debouncer.
+// It falls back to runByTime if src can not be watched. It returns when the task is stopped.
+func (t *Task) runWatched(name string, run func() bool) {
+	w, err := watch.New(t.Src)
+	if err != nil {
+		glog.Warningf("watch %v failed, will run it by period or schedule: %v", name, err)
+		t.runByTime(name, run)
+		return
+	}
+	defer w.Close()
+	glog.Infof("%v watches %v", name, t.Src)
+
+	// changes while not watched are unknown
+	if t.overdue(time.Now()) {
+		glog.Warningf("%v has not been executed since %v, will execute it right now.", name, t.LastSuccTime)
+		if !run() {
+			return
+		}
+	}
+
+	d := &watch.Debouncer{Quiet: t.Watch.quietPeriod, MaxDelay: t.Watch.maxDelay}
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if d.Pending() {
+			timer = time.NewTimer(d.Due().Sub(time.Now()))
+			due = timer.C
+		}
+		var fallback error
+		select {
+		case <-t.ctx.Done():
+			glog.Warning(name + " stopped.")
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case path, ok := <-w.Events():
+			if !ok {
+				fallback = errors.New("watcher closed")
+			} else if !copier.IsFiltered(path, t.FilteredFiles) {
+				glog.V(3).Infof("%v: %v changed", name, path)
+				d.Add(time.Now())
+			}
+		case err := <-w.Errors():
+			if err == watch.ErrOverflow {
+				d.Add(time.Now())
+			} else {
+				fallback = err
+			}
+		case <-t.control.trigger:
+			glog.Infof("%v is triggered, will execute it right now.", name)
+			d.Reset()
+			if !run() {
+				return
+			}
+		case <-due:
+			d.Reset()
+			if !run() {
+				return
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if fallback != nil {
+			glog.Warningf("watch %v failed, will run it by period or schedule: %v", name, fallback)
+			w.Close()
+			t.runByTime(name, run)
+			return
+		}
+	}
+}
+
+// copyWait return the Wait of the copy options, which pauses the copy while the task is paused,
+// and pauses or aborts the copy when the windows close. A paused copy stops once ctx is done.
+func (t *Task) copyWait(ctx context.Context) func() error {
+	windowClose := t.windows != nil && t.WindowClose != WindowCloseContinue
+	if t.control == nil && !windowClose {
+		return nil
+	}
+	return func() error {
+		if t.control != nil && t.control.paused() {
+			glog.Warningf("task %v paused until it is resumed", t.Name)
+			if !t.control.waitResumed(ctx.Done()) {
+				return ctx.Err()
+			}
+			glog.Infof("task %v resumed", t.Name)
+		}
+		if !windowClose || t.windows.Open(time.Now()) {
+			return nil
+		}
+		if t.WindowClose == WindowCloseAbort {
+			return errors.New("aborted as the window closed")
+		}
+		glog.Warningf("task %v paused until the window opens at %v", t.Name, t.windows.NextOpen(time.Now()))
+		if !waitWindow(t.windows, ctx.Done()) {
+			return ctx.Err()
+		}
+		glog.Infof("task %v resumed", t.Name)
+		return nil
+	}
+}
+
+// copyProgress return the Progress of the copy options, which records the progress of the run
+func (t *Task) copyProgress() func(path string, size int64) {
+	if t.control == nil {
+		return nil
+	}
+	return t.control.done
+}
+
+// waitWindow blocks until windows are open, it return false if stopCh is closed before
+func waitWindow(windows *schedule.Windows, stopCh <-chan struct{}) bool {
+	for !windows.Open(time.Now()) {
+		timer := time.NewTimer(checkWait(windows.NextOpen(time.Now())))
+		select {
+		case <-stopCh:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+	return true
+}
+
+// checkWait return the wait until next, but at most values.ScheduleCheckInterval,
+// so the wall clock is rechecked after the system sleeps
+func checkWait(next time.Time) time.Duration {
+	wait := next.Sub(time.Now())
+	if wait > values.ScheduleCheckInterval {
+		wait = values.ScheduleCheckInterval
+	}
+	return wait
+}
+
+// runContext return the context of a run, which is cancelled when the task stops or the run times out.
+// It is not cancelled when the task is modified, the run finishes before the modified task starts.
+func (t *Task) runContext() (context.Context, context.CancelFunc) {
+	if t.timeout > 0 {
+		return context.WithTimeout(t.runCtx, t.timeout)
+	}
+	return context.WithCancel(t.runCtx)
+}
+
+// runWithRetry runs job by run, and runs it again by the retry policy of the task while it fails.
+// Only the first run is triggered. It return false if the task is stopped.
+func (t *Task) runWithRetry(name string, triggered bool, job func() error) bool {
+	for n := 1; ; n++ {
+		var err error
+		if !t.run(name, triggered && n == 1, func() error {
+			err = job()
+			return err
+		}) {
+			return false
+		}
+		if t.ctx.Err() != nil {
+			return false
+		}
+		if err == nil || t.Retry == nil || n >= t.Retry.policy.MaxAttempts {
+			return true
+		}
+		delay := t.Retry.policy.Delay(n)
+		glog.Warningf("%v failed, will retry in %v, attempt %d of %d", name, delay, n+1, t.Retry.policy.MaxAttempts)
+		timer := time.NewTimer(delay)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			glog.Warning(name + " stopped.")
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// run runs job after a random start jitter, once the windows are open and TaskQueue has a free slot.
+// A paused task waits until it is resumed, a triggered run skips the jitter and windows.
+// It return false if the task is stopped before job runs.
+func (t *Task) run(name string, triggered bool, job func() error) bool {
+	if t.control.paused() {
+		glog.Warningf("%v is paused, will execute it once resumed.", name)
+		if !t.control.waitResumed(t.ctx.Done()) {
+			glog.Warning(name + " stopped.")
+			return false
+		}
+	}
+	if t.startJitter > 0 && !triggered {
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(t.startJitter))))
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			glog.Warning(name + " stopped.")
+			return false
+		case <-timer.C:
+		}
+	}
+	for {
+		if t.windows != nil && !triggered && !t.windows.Open(time.Now()) {
+			glog.Warningf("%v is deferred to the window opening at %v", name, t.windows.NextOpen(time.Now()))
+			if !waitWindow(t.windows, t.ctx.Done()) {
+				glog.Warning(name + " stopped.")
+				return false
+			}
+		}
+		if TaskQueue.Full() {
+			running, waiting := TaskQueue.Stat()
+			glog.Infof("%v is queued, %d running and %d waiting", name, running, waiting)
+		}
+		if !TaskQueue.Acquire(t.Priority, t.ctx.Done()) {
+			glog.Warning(name + " stopped.")
+			return false
+		}
+		// the windows may have closed while queued
+		if t.windows == nil || triggered || t.windows.Open(time.Now()) {
+			break
+		}
+		TaskQueue.Release()
+	}
+	defer TaskQueue.Release()
+	if !RunningTasks.beginRun() {
+		glog.Warning(name + " not started, as the backup process is shutting down.")
+		return false
+	}
+	defer RunningTasks.endRun()
+	if !t.runs.beginRun() {
+		glog.Warning(name + " not started, as the task is modified.")
+		return false
+	}
+	defer t.runs.endRun()
+	t.control.begin()
+	defer t.control.end()
+	if err := job(); err != nil {
+		glog.Error(err.Error())
+	}
+	return true
+}
+
+// prerequisites collects the prerequisites of a task succeeded since its last run, and since the last failure
+// of any of them, so the task runs once all of them succeeded in the same cycle
+type prerequisites struct {
+	mu        sync.Mutex
+	names []string
+	done  map[string]bool
+	// signaled when all prerequisites succeeded
+	ready chan struct{}
+}
+
+func newPrerequisites(names []string) *prerequisites {
+	p := &prerequisites{done: make(map[string]bool), ready: make(chan struct{}, 1)}
+	for _, name := range names {
+		if !p.has(name) {
+			p.names = append(p.names, strings.ToLower(name))
+		}
+	}
+	return p
+}
+
+func (p *prerequisites) has(name string) bool {
+	for _, n := range p.names {
+		if n == strings.ToLower(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *prerequisites) succeeded(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.has(name) {
+		p.done[strings.ToLower(name)] = true
+	}
+	if len(p.done) < len(p.names) {
+		return
+	}
+	p.done = make(map[string]bool)
+	select {
+	case p.ready <- struct{}{}:
+	default:
+		// a run is already pending
+	}
+}
+
+// failed forgets the successes collected if the task of the name is a prerequisite
+func (p *prerequisites) failed(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.has(name) {
+		p.done = make(map[string]bool)
+	}
+}
+
+// reset forgets the successes collected and a pending run, as the task is running
+func (p *prerequisites) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = make(map[string]bool)
+	select {
+	case <-p.ready:
+	default:
+	}
+}
+
+// taskControl holds the requests of the control endpoint to a started task, it is kept when the task restarts
+type taskControl struct {
+	// signaled to run the task right now
+	trigger chan struct{}
+	mu      sync.Mutex
+	// set until the triggered run starts
+	triggered bool
+	// closed when the task is resumed, nil if the task is not paused
+	resumed chan struct{}
+	// the number of runs in progress
+	runs int
+	// the progress of the current run, nil if not running
+	progress *control.Progress
+}
+
+func newTaskControl() *taskControl {
+	return &taskControl{trigger: make(chan struct{}, 1)}
+}
+
+// Trigger requests a run right now, it return an error if the task is paused
+func (c *taskControl) Trigger() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		return errors.New("the task is paused")
+	}
+	c.triggered = true
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+		// a run is already pending
+	}
+	return nil
+}
+
+// takeTriggered return whether a run was triggered, and clears the request as the run starts
+func (c *taskControl) takeTriggered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	triggered := c.triggered
+	c.triggered = false
+	select {
+	case <-c.trigger:
+	default:
+	}
+	return triggered
+}
+
+// Pause defers the runs until Resume, it return false if the task is already paused
+func (c *taskControl) Pause() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		return false
+	}
+	c.resumed = make(chan struct{})
+	return true
+}
+
+// Resume return false if the task is not paused
+func (c *taskControl) Resume() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed == nil {
+		return false
+	}
+	close(c.resumed)
+	c.resumed = nil
+	return true
+}
+
+func (c *taskControl) paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed != nil
+}
+
+// waitResumed blocks while the task is paused, it return false if stopCh is closed before
+func (c *taskControl) waitResumed(stopCh <-chan struct{}) bool {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-stopCh:
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+func (c *taskControl) begin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs++
+	c.progress = &control.Progress{Started: time.Now()}
+}
+
+func (c *taskControl) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs--
+	if c.runs == 0 {
+		c.progress = nil
+	}
+}
+
+// done records a file done by the current run
+func (c *taskControl) done(path string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.progress != nil {
+		c.progress.Files++
+		c.progress.Bytes += size
+		c.progress.File = path
+	}
+}
+
+// currentProgress return a copy of the progress of the current run, nil if not running
+func (c *taskControl) currentProgress() *control.Progress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.progress == nil {
+		return nil
+	}
+	p := *c.progress
+	return &p
+}
+
+// state return one of the control states
+func (c *taskControl) state() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		return control.StatePaused
+	}
+	if c.runs > 0 {
+		return control.StateRunning
+	}
+	return control.StateIdle
+}
+
+// runCounter counts the runs in progress, and stops starting runs once drained
+type runCounter struct {
+	mu sync.Mutex
+	// the number of runs in progress
+	active int
+	// set when drained, closed when no run is in progress
+	drained chan struct{}
+}
+
+// taskSet is the set of running tasks, its runs are drained when the daemon shuts down
+type taskSet struct {
+	runCounter
+	mu    sync.Mutex
+	tasks []*Task
+}
+
+// RunningTasks are the tasks started by the daemon
+var RunningTasks = &taskSet{}
+
+// taskKeys return the identities of tasks, the lower case name, and the occurrence for tasks of the same name
+func taskKeys(names []string) []string {
+	keys := make([]string, len(names))
+	seen := make(map[string]int)
+	for i, name := range names {
+		name = strings.ToLower(name)
+		keys[i] = name + "#" + strconv.Itoa(seen[name])
+		seen[name]++
+	}
+	return keys
+}
+
+// fingerprint return the configuration of the task, a task with the same fingerprint needs no restart on reload
+func (t *Task) fingerprint() string {
+	c := t.copy()
+	c.LastSuccTime, c.RecentResult, c.LastCheckTime, c.RecentCheckResult = time.Time{}, nil, time.Time{}, nil
+	c.LastError = ""
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		glog.Error(err)
+	}
+	return fmt.Sprint(string(data), t.loc, t.startJitter, t.keyFile)
+}
+
+// Update replaces the running tasks with tasks: removed tasks are stopped, new tasks are started,
+// and modified tasks are restarted once their runs in progress finished. Unchanged tasks keep running,
+// including their runs in progress.
+func (s *taskSet) Update(tasks []Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldNames := make([]string, len(s.tasks))
+	for i, t := range s.tasks {
+		oldNames[i] = t.Name
+	}
+	old := make(map[string]*Task)
+	for i, key := range taskKeys(oldNames) {
+		old[key] = s.tasks[i]
+	}
+
+	newNames := make([]string, len(tasks))
+	for i := range tasks {
+		newNames[i] = tasks[i].Name
+	}
+	running := make([]*Task, 0, len(tasks))
+	for i, key := range taskKeys(newNames) {
+		t := &tasks[i]
+		prev, ok := old[key]
+		if ok {
+			delete(old, key)
+			if prev.fingerprint() == t.fingerprint() {
+				running = append(running, prev)
+				continue
+			}
+			glog.Warningf("task %v modified, will restart it once its runs in progress finished.", t.Name)
+			prev.retire(nil)
+			t.keepStatus(prev)
+			// a paused task stays paused
+			t.control = prev.control
+		} else {
+			glog.Warningf("task %v added, will start it.", t.Name)
+			t.control = newTaskControl()
+		}
+		t.runCtx, t.cancel = context.WithCancelCause(context.Background())
+		t.ctx, t.retire = context.WithCancelCause(t.runCtx)
+		t.statusMu = &sync.Mutex{}
+		t.runs = &runCounter{}
+		if len(t.After) > 0 {
+			t.prerequisites = newPrerequisites(t.After)
+		}
+		if prev != nil {
+			// the task replacing this one waits until this one took over prev
+			t.runs.beginRun()
+			go t.replace(prev)
+		} else {
+			go t.start()
+		}
+		running = append(running, t)
+	}
+	for _, t := range old {
+		glog.Warningf("task %v removed, will stop it.", t.Name)
+		t.cancel(nil)
+	}
+	s.tasks = running
+}
+
+// keepStatus sets the status of the task to the one of prev, the task it replaces
+func (t *Task) keepStatus(prev *Task) {
+	p := prev.copy()
+	defer t.lockStatus()()
+	t.LastSuccTime, t.RecentResult, t.LastError = p.LastSuccTime, p.RecentResult, p.LastError
+	t.LastCheckTime, t.RecentCheckResult = p.LastCheckTime, p.RecentCheckResult
+}
+
+// replace starts the task in place of prev, the task before it was modified, once the runs of prev in progress
+// finished. The results of those runs are kept. Their runs are interrupted if the task is stopped before.
+func (t *Task) replace(prev *Task) {
+	drained := prev.runs.Drain()
+	select {
+	case <-drained:
+	case <-t.runCtx.Done():
+		prev.cancel(context.Cause(t.runCtx))
+		<-drained
+	}
+	prev.cancel(nil)
+	before := t.copy()
+	t.keepStatus(prev)
+	after := t.copy()
+	t.runs.endRun()
+	if !reflect.DeepEqual(before.RecentResult, after.RecentResult) ||
+		!reflect.DeepEqual(before.RecentCheckResult, after.RecentCheckResult) {
+		BackupStatusCh <- "update status"
+	}
+	if t.ctx.Err() == nil {
+		t.start()
+	}
+}
+
+// beginRun records the start of a run, it return false if drained
+func (s *runCounter) beginRun() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drained != nil {
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *runCounter) endRun() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.drained != nil && s.active == 0 {
+		close(s.drained)
+	}
+}
+
+// Drain stops starting runs, the returned channel is closed when no run is in progress
+func (s *runCounter) Drain() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+		if s.active == 0 {
+			close(s.drained)
+		}
+	}
+	return s.drained
+}
+
+// Stop stops all tasks, the runs in progress are cancelled with the cause
+func (s *taskSet) Stop(cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		t.cancel(cause)
+	}
+}
+
+// List return a copy of the running tasks
+func (s *taskSet) List() []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]Task, len(s.tasks))
+	for i, t := range s.tasks {
+		tasks[i] = t.copy()
+	}
+	return tasks
+}
+
+// find return the running task of the name, or nil if not found
+func (s *taskSet) find(name string) *Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if strings.EqualFold(t.Name, name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Status return the status of the running tasks
+func (s *taskSet) Status() []control.TaskStatus {
+	now := time.Now()
+	var status []control.TaskStatus
+	for _, t := range s.List() {
+		status = append(status, t.status(now))
+	}
+	return status
+}
+
+// succeeded tells the tasks after the task of the name that it succeeded
+func (s *taskSet) succeeded(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if t.prerequisites != nil {
+			t.prerequisites.succeeded(name)
+		}
+	}
+}
+
+// failed tells the tasks after the task of the name that it failed
+func (s *taskSet) failed(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if t.prerequisites != nil {
+			t.prerequisites.failed(name)
+		}
+	}
+}
+
+// runTriggered calls run every time trigger or ready is signaled, run return false if the task is stopped.
+// It returns when stopCh is closed.
+func runTriggered(name string, stopCh <-chan struct{}, trigger <-chan struct{}, ready chan struct{}, run func() bool) {
+	glog.Infof("%v waits for its prerequisites", name)
+	for {
+		select {
+		case <-stopCh:
+			glog.Warning(name + " stopped.")
+			return
+		case <-trigger:
+			glog.Infof("%v is triggered, will execute it right now.", name)
+			if !run() {
+				return
+			}
+		case <-ready:
+			glog.Infof("prerequisites of %v succeeded, will execute it right now.", name)
+			if !run() {
+				return
+			}
+		}
+	}
+}
+
+// runScheduled calls run at the times of sched, and every time trigger is signaled. The first call is right now
+// if a time since last was missed. run return false if the task is stopped. It returns when stopCh is closed.
+func runScheduled(name string, last time.Time, sched *schedule.Cron, stopCh <-chan struct{}, trigger <-chan struct{},
+	run func() bool) {
+	next := sched.Next(last)
+	if !next.After(time.Now()) {
+		glog.Warningf("%v missed the scheduled run at %v, will execute it right now.", name, next)
+		if !run() {
+			return
+		}
+		next = sched.Next(time.Now())
+	}
+	glog.Infof("next run of %v at %v", name, next)
+
+	for {
+		timer := time.NewTimer(checkWait(next))
+		select {
+		case <-stopCh:
+			timer.Stop()
+			glog.Warning(name + " stopped.")
+			return
+		case <-trigger:
+			timer.Stop()
+			glog.Infof("%v is triggered, will execute it right now.", name)
+			if !run() {
+				return
+			}
+			// the scheduled time passed during the run is covered by it
+			if !next.After(time.Now()) {
+				next = sched.Next(time.Now())
+				glog.Infof("next run of %v at %v", name, next)
+			}
+		case <-timer.C:
+			if time.Now().Before(next) {
+				continue
+			}
+			if !run() {
+				return
+			}
+			next = sched.Next(time.Now())
+			glog.Infof("next run of %v at %v", name, next)
+		}
+	}
+}
+
+// runPeriodically calls run every period, the first call is one period after last, or right now if it is overdue.
+// Every time trigger is signaled run is called right now, and the next call is a period later.
+// run return false if the task is stopped. It returns when stopCh is closed.
+func runPeriodically(name string, last time.Time, period time.Duration, stopCh <-chan struct{}, trigger <-chan struct{},
+	run func() bool) {
+	var interval = time.Now().Sub(last)
+
+	if interval > period {
+		glog.Warningf("%v has not been executed for %v, which is logger than %v, will execute it right now.",
+			name, interval, period)
+		if !run() {
+			return
+		}
+	} else {
+		firstWait := time.NewTimer(period - interval)
+		defer firstWait.Stop()
+
+		select {
+		case <-stopCh:
+			glog.Warning(name + " stopped.")
+			return
+		case <-trigger:
+			glog.Infof("%v is triggered, will execute it right now.", name)
+			if !run() {
+				return
+			}
+		case <-firstWait.C:
+			if !run() {
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			glog.Warning(name + " stopped.")
+			return
+		case <-trigger:
+			glog.Infof("%v is triggered, will execute it right now.", name)
+			if !run() {
+				return
+			}
+			// the next run is a period later, drop the tick during the run
+			ticker.Reset(period)
+			select {
+			case <-ticker.C:
+			default:
+			}
+		case <-ticker.C:
+			if !run() {
+				return
+			}
+			// drop the tick missed by a deferred, queued or long run, the next run is a period later
+			select {
+			case <-ticker.C:
+			default:
+			}
+		}
+	}
+}
+
+// runCheck checks the integrity of the repository of the task
+func (t *Task) runCheck() (err error) {
+	defer t.dealCheckResult(&err)
+	glog.Infof("start check for task %v", t.Name)
+	r, err := t.repository()
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	result, err := r.Check(t.Check.ReadPercent)
+	if err != nil {
+		glog.Errorf("check repository %s failed: %v", r.Root, err)
+		return err
+	}
+	glog.Infof("check of task %v finished: %v", t.Name, result)
+	if !result.OK() {
+		return errors.New(result.Problems())
+	}
+	return nil
+}
+
+func (t *Task) dealCheckResult(err *error) {
+	unlock := t.lockStatus()
+	currTime := time.Now()
+	t.LastCheckTime = currTime
+	result := "ok"
+	if *err != nil {
+		result = "fail: " + (*err).Error()
+	}
+
+	record := []string{currTime.Format("2006-01-02 15:04:05") + " " + result}
+	if len(t.RecentCheckResult) >= values.RecentRecordCount {
+		t.RecentCheckResult = append(record, t.RecentCheckResult[0:values.RecentRecordCount-1]...)
+	} else {
+		t.RecentCheckResult = append(record, t.RecentCheckResult...)
+	}
+	unlock()
+
+	BackupStatusCh <- "update status"
+}
+
+func (t *Task) equals(task Task) bool {
+	if strings.EqualFold(filepath.Clean(t.Src), filepath.Clean(task.Src)) &&
+		strings.EqualFold(filepath.Clean(t.Dst), filepath.Clean(task.Dst)) {
+		return true
+	}
+	return false
+}
+
+// restoreSource return the backup version of the task, the snapshot of the name if it is not empty,
+// or the one at the time (the latest one if at is zero), and the directory the backup was taken from.
+func (t *Task) restoreSource(at time.Time, name string) (restore.Source, string, error) {
+	var src restore.Source
+	var selected *snapshot.Snapshot
+	if t.Format == FormatRepository || t.Mode == ModeSnapshot {
+		snapshots, err := t.snapshots()
+		if err != nil {
+			return nil, "", err
+		}
+		if name != "" {
+			if selected = findSnapshot(snapshots, name); selected == nil {
+				return nil, "", errors.New("snapshot " + name + " of task " + t.Name + " not found")
+			}
+		} else if selected = selectSnapshot(snapshots, at); selected == nil {
+			return nil, "", errors.New("no snapshot of task " + t.Name + " before " + at.Format("2006-01-02 15:04:05"))
+		}
+		if t.Format == FormatRepository {
+			r, err := t.repository()
+			if err != nil {
+				return nil, "", err
+			}
+			m, err := r.LoadManifest(*selected)
+			if err != nil {
+				return nil, "", err
+			}
+			// task directories of different names may be the same, see repository.SameTaskDir
+			if m.Task != t.Name || !snapshot.Matches(selected.Name, m.Time) {
+				return nil, "", errors.New("snapshot " + selected.Name + " is of task " + m.Task + " at " +
+					m.Time.Format(snapshot.TimeFormat) + ", not of task " + t.Name)
+			}
+			src = r.Source(m)
+		} else {
+			src = &restore.DirSource{Root: selected.Path}
+		}
+	} else {
+		if name != "" {
+			return nil, "", errors.New("task " + t.Name + " is in " + t.Mode + " mode and only keeps the latest version")
+		}
+		if !at.IsZero() {
+			glog.Warningf("task %v is in %v mode and only keeps the latest version, the time is ignored", t.Name, t.Mode)
+		}
+		src = &restore.DirSource{Root: filepath.Join(t.Dst, filepath.Base(t.Src))}
+	}
+	if selected != nil {
+		glog.Infof("restore task %v from snapshot %v", t.Name, selected.Name)
+	}
+
+	// a file task is restored into the directory of the file, the source may have been deleted,
+	// so check the backup as well
+	origin := t.Src
+	if fi, err := os.Stat(t.Src); err == nil && fi.Mode().IsRegular() {
+		origin = filepath.Dir(t.Src)
+	} else if err != nil {
+		if files, err := src.Files(); err == nil && len(files) == 1 && files[0].Path == filepath.Base(t.Src) {
+			origin = filepath.Dir(t.Src)
+		}
+	}
+	return src, origin, nil
+}
+
+// snapshots return the snapshots of a task in snapshot mode or repository format, oldest first
+func (t *Task) snapshots() ([]snapshot.Snapshot, error) {
+	if t.Format == FormatRepository {
+		r, err := t.repository()
+		if err != nil {
+			return nil, err
+		}
+		return r.Snapshots(t.Name)
+	}
+	if t.Mode == ModeSnapshot {
+		return snapshot.List(t.snapshotRoot())
+	}
+	return nil, errors.New("task " + t.Name + " is in " + t.Mode + " mode and only keeps the latest version")
+}
+
+// findSnapshot return the snapshot of the name, or nil if not found
+func findSnapshot(snapshots []snapshot.Snapshot, name string) *snapshot.Snapshot {
+	for i := range snapshots {
+		if snapshots[i].Name == name {
+			return &snapshots[i]
+		}
+	}
+	return nil
+}
+
+// selectSnapshot return the latest snapshot taken before at, or the latest one if at is zero
+func selectSnapshot(snapshots []snapshot.Snapshot, at time.Time) *snapshot.Snapshot {
+	var selected *snapshot.Snapshot
+	for i := range snapshots {
+		if at.IsZero() || !snapshots[i].Time.After(at) {
+			selected = &snapshots[i]
+		}
+	}
+	return selected
+}
+
+// restoreCommand restores files from the backup of a task, the usage is
+// backup restore [-at time] [-target dir] [-conflict overwrite|skip|keep-both] <task name> [glob ...]
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	atString := fs.String("at", "", "restore the latest version before the time, like \"2006-01-02 15:04:05\"")
+	target := fs.String("target", "", "restore into the directory instead of the original source")
+	conflict := fs.String("conflict", restore.ConflictKeepBoth, "what to do with existing files: overwrite, skip or keep-both")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: backup restore [-at time] [-target dir] [-conflict policy] <task name> [glob ...]")
+	}
+	if !restore.ValidConflict(*conflict) {
+		return errors.New("invalid conflict policy " + *conflict)
+	}
+	var at time.Time
+	if *atString != "" {
+		var err error
+		if at, err = util.ParseTime(*atString); err != nil {
+			return err
+		}
+	}
+
+	c, err := loadConfig("")
+	if err != nil {
+		return err
+	}
+	task := c.findTask(fs.Arg(0))
+	if task == nil {
+		return errors.New("task " + fs.Arg(0) + " not found")
+	}
+
+	src, origin, err := task.restoreSource(at, "")
+	if err != nil {
+		return err
+	}
+	opts := restore.Options{Target: origin, Globs: fs.Args()[1:], Conflict: *conflict}
+	if *target != "" {
+		opts.Target = filepath.Clean(*target)
+	}
+	summary, err := restore.Restore(src, opts)
+	if summary != nil {
+		for _, f := range summary.Files {
+			fmt.Println("restored " + f)
+		}
+		for _, e := range summary.Errors {
+			fmt.Println("failed " + e)
+		}
+		fmt.Printf("task %s restored to %s: %v\n", task.Name, opts.Target, summary)
+	}
+	return err
+}
+
+// checkCommand checks the repositories of the tasks (all repository format tasks if none is given),
+// the usage is
+// backup check [-read-percent n] [task name ...]
+func checkCommand(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	readPercent := fs.Float64("read-percent", 0, "the percentage (0 ~ 100) of blobs to re-read, by default the task config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *readPercent < 0 || *readPercent > 100 {
+		return errors.New("read-percent should be between 0 and 100")
+	}
+
+	c, err := loadConfig("")
+	if err != nil {
+		return err
+	}
+	var tasks []*Task
+	for _, name := range fs.Args() {
+		task := c.findTask(name)
+		if task == nil {
+			return errors.New("task " + name + " not found")
+		}
+		if task.Format != FormatRepository {
+			return errors.New("task " + name + " is not in repository format")
+		}
+		tasks = append(tasks, task)
+	}
+	if len(tasks) == 0 {
+		for i := range c.backupConfig.Tasks {
+			if c.backupConfig.Tasks[i].Format == FormatRepository {
+				tasks = append(tasks, &c.backupConfig.Tasks[i])
+			}
+		}
+	}
+
+	// tasks with the same dst share the repository
+	checked := make(map[string]bool)
+	failed := 0
+	for _, task := range tasks {
+		r, err := task.repository()
+		if err != nil {
+			fmt.Printf("task %s: %v\n", task.Name, err)
+			failed++
+			continue
+		}
+		if checked[r.Root] {
+			continue
+		}
+		checked[r.Root] = true
+		percent := *readPercent
+		if percent == 0 && task.Check != nil {
+			percent = task.Check.ReadPercent
+		}
+		result, err := r.Check(percent)
+		if err != nil {
+			fmt.Printf("repository %s: %v\n", r.Root, err)
+			failed++
+			continue
+		}
+		for _, m := range result.BadManifests {
+			fmt.Println("bad manifest " + m)
+		}
+		for _, id := range result.Missing {
+			fmt.Println("missing blob " + id)
+		}
+		for _, id := range result.Damaged {
+			fmt.Println("damaged blob " + id)
+		}
+		for _, id := range result.Repaired {
+			fmt.Println("repaired blob " + id)
 		}
+		fmt.Printf("repository %s: %v\n", r.Root, result)
+		if !result.OK() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d repositories have problems", failed)
 	}
 	return nil
 }
 
-type Task struct {
-	Src            string `yaml:"src"`
-	Dst            string `yaml:"dst"`
-	PeriodString   string `yaml:"period"`
-	PeriodDuration time.Duration
-	Name           string `yaml:"name"`
-	ticker         <-chan time.Time
-	stopCh         chan string
-	LastSuccTime   time.Time `yaml:"last_succ_time"`
-	RecentResult   []string  `yaml:"recent_result"`
-	FilteredFiles  []string  `yaml:"filtered_files"`
-}
+// runCommand runs a task once right now, regardless of its schedule and windows. If the daemon is running,
+// it is asked to run the task, otherwise the task runs in this process and the result is recorded in the
+// status file. The timeout and retry of the task still apply. The usage is
+// backup run <task name>
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: backup run <task name>")
+	}
+	c, err := loadConfig("")
+	if err != nil {
+		return err
+	}
+	task := c.findTask(fs.Arg(0))
+	if task == nil {
+		return errors.New("task " + fs.Arg(0) + " not found")
+	}
+	// the daemon would overwrite the result in the status file, and may run the task at the same time
+	resp, err := callDaemon(c, control.Request{Command: control.CommandTrigger, Task: task.Name})
+	if err == nil {
+		fmt.Printf("task %s: run requested from the daemon, see backup status %s\n", task.Name, task.Name)
+		return nil
+	} else if resp != nil {
+		return err
+	}
 
-func (t *Task) check() (err error) {
-	if !util.Exists(t.Src) {
-		err = errors.New(t.Src + " does not exist, will skip the task " + t.Name)
-		glog.Error(err.Error())
+	// refuse before recording a failure, the run in the other process writes the status
+	lock, err := task.lock()
+	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
+	task.lockFile = ""
 
-	if !util.Exists(t.Dst) {
-		glog.Warning(t.Dst + " does not exist, will create it.")
-		if err = os.Mkdir(t.Dst, os.ModePerm); err != nil {
-			glog.Error("make directory " + t.Dst + " failed: " + err.Error())
-			return err
+	// the results are written into the status file once the run finished
+	statusCh := make(chan string, 10)
+	BackupStatusCh = statusCh
+	go func() {
+		for range statusCh {
 		}
+	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	task.runCtx, task.cancel = context.WithCancelCause(ctx)
+	defer task.cancel(nil)
+	task.ctx = task.runCtx
+	task.windows = nil
+	policy := util.RetryPolicy{MaxAttempts: 1}
+	if task.Retry != nil {
+		policy = task.Retry.policy
 	}
+	err = policy.Do(task.ctx, func() error {
+		ctx, cancel := task.runContext()
+		defer cancel()
+		return task.work(ctx)
+	})
 
-	fi, err := os.Stat(t.Dst)
-	if err != nil {
-		glog.Error(err.Error())
-		return err
+	// the status file may have been updated by the daemon during the run
+	done := *task
+	if c.Parse() == nil {
+		if task = c.findTask(done.Name); task != nil {
+			task.LastSuccTime = done.LastSuccTime
+			task.RecentResult = done.RecentResult
+			task.LastError = done.LastError
+		}
 	}
-	if fi.Mode().IsRegular() {
-		err = errors.New("dst directory " + t.Dst + " is regular file!")
-		glog.Error(err)
+	if err := c.writeStatus(c.backupConfig.Tasks); err != nil {
 		return err
 	}
-	return nil
+	fmt.Printf("task %s: %s\n", done.Name, done.RecentResult[0])
+	return err
 }
 
-func (t *Task) dealResult(err *error) {
-	currTime := time.Now()
-	result := ""
-	if *err == nil {
-		t.LastSuccTime = currTime
-		result = "success"
+// statusCommand prints the status of the tasks, with the recent results of the tasks if they are given.
+// The status is asked from the daemon, or read from the status file if the daemon is not reachable. The usage is
+// backup status [task name ...]
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := loadConfig("")
+	if err != nil {
+		return err
+	}
+	var tasks []control.TaskStatus
+	if resp, err := callDaemon(c, control.Request{Command: control.CommandStatus}); err == nil {
+		tasks = resp.Tasks
 	} else {
-		result = "fail"
+		fmt.Fprintf(os.Stderr, "the daemon is not reachable (%v), show the status in %s\n", err, c.statusFilePath)
+		for i := range c.backupConfig.Tasks {
+			tasks = append(tasks, c.backupConfig.Tasks[i].status(time.Now()))
+		}
 	}
 
-	record := []string{currTime.Format("2006-01-02 15:04:05") + " " + result}
-
-	if len(t.RecentResult) >= values.RecentRecordCount {
-		t.RecentResult = append(record, t.RecentResult[0:values.RecentRecordCount-1]...)
-	} else {
-		t.RecentResult = append(record, t.RecentResult...)
+	if fs.NArg() > 0 {
+		for _, name := range fs.Args() {
+			var task *control.TaskStatus
+			for i := range tasks {
+				if strings.EqualFold(tasks[i].Name, name) {
+					task = &tasks[i]
+					break
+				}
+			}
+			if task == nil {
+				return errors.New("task " + name + " not found")
+			}
+			fmt.Printf("task %s\n", task.Name)
+			if task.State != "" {
+				fmt.Printf("  state:        %s\n", task.State)
+			}
+			fmt.Printf("  last success: %s\n", formatTime(task.LastSuccTime))
+			fmt.Printf("  next run:     %s\n", formatTime(task.NextRun))
+			if p := task.Progress; p != nil {
+				fmt.Printf("  progress:     %d files, %d bytes since %s, last %s\n", p.Files, p.Bytes,
+					formatTime(p.Started), p.File)
+			}
+			fmt.Println("  recent results:")
+			for _, r := range task.RecentResult {
+				fmt.Println("    " + r)
+			}
+			if !task.LastCheckTime.IsZero() || len(task.RecentCheckResult) > 0 {
+				fmt.Printf("  last check:   %s\n", formatTime(task.LastCheckTime))
+				fmt.Println("  recent check results:")
+				for _, r := range task.RecentCheckResult {
+					fmt.Println("    " + r)
+				}
+			}
+		}
+		return nil
 	}
 
-	BackupStatusCh <- "update status"
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tSTATE\tLAST SUCCESS\tNEXT RUN\tRECENT RESULT")
+	for _, task := range tasks {
+		state, recent := task.State, "-"
+		if state == "" {
+			state = "-"
+		}
+		if len(task.RecentResult) > 0 {
+			recent = task.RecentResult[0]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", task.Name, state, formatTime(task.LastSuccTime),
+			formatTime(task.NextRun), recent)
+	}
+	return w.Flush()
 }
 
-func (t *Task) work() (err error) {
-	defer t.dealResult(&err)
-	glog.Infof("start work for task %v", t.Name)
-	if err = t.check(); err != nil {
-		glog.Error("task check error: " + err.Error() + ", task name: " + t.Name)
-		return err
-	}
+// callDaemon sends req to the daemon through its control socket
+func callDaemon(c *Config, req control.Request) (*control.Response, error) {
+	return control.Call("unix", c.controlConfig().Socket, req)
+}
 
-	fi, err := os.Stat(t.Src)
-	if err != nil {
-		glog.Error(err)
-		return err
+// waitDaemonExit waits until the control socket of the daemon is closed, which is the last thing before it exits.
+// The runs in progress are interrupted after the shutdown grace period, so it waits a little longer than that.
+func waitDaemonExit(c *Config) error {
+	deadline := time.Now().Add(c.backupConfig.shutdownGrace + values.ShutdownInterruptWait + 5*time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := callDaemon(c, control.Request{Command: control.CommandStatus}); err != nil && resp == nil {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
 	}
+	return errors.New("the daemon did not exit in time")
+}
 
-	// if src is a regular file, just copy it to dst
-	var output string
-	if fi.Mode().IsRegular() {
-		srcFileDir := filepath.Dir(t.Src)
-		srcFile := filepath.Base(t.Src)
-		args := []string{srcFileDir, t.Dst, srcFile, "/xf"}
-		args = append(args, t.FilteredFiles...)
-		output, err = util.DealRobocopyResult(util.RunCommandWithRetry(values.RobocopyRetryCount, "robocopy",
-			args...))
+// controlCommand return the command sending the request of the name to the daemon, the usage is
+// backup trigger|pause|resume <task name>, or backup reload|stop
+func controlCommand(name string) func(args []string) error {
+	return func(args []string) error {
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		req := control.Request{Command: name}
+		if name == control.CommandReload || name == control.CommandStop {
+			if fs.NArg() != 0 {
+				return errors.New("usage: backup " + name)
+			}
+		} else if fs.NArg() != 1 {
+			return errors.New("usage: backup " + name + " <task name>")
+		} else {
+			req.Task = fs.Arg(0)
+		}
+		c, err := loadConfig("")
 		if err != nil {
-			glog.Errorf("exec command {robocopy %s} failed: %v\n%v", strings.Join(args, " "), err, output)
 			return err
 		}
-	} else if fi.Mode().IsDir() {
-		dstPath := filepath.Join(t.Dst, filepath.Base(t.Src))
-		args := []string{t.Src, dstPath, "/e", "/xf"}
-		args = append(args, t.FilteredFiles...)
-		output, err = util.DealRobocopyResult(util.RunCommandWithRetry(values.RobocopyRetryCount, "robocopy",
-			args...))
+		resp, err := callDaemon(c, req)
 		if err != nil {
-			glog.Errorf("exec command {robocopy %s} failed: %v\n%v", strings.Join(args, " "), err, output)
 			return err
 		}
-	} else {
-		err = errors.New(t.Src + "is neither a file nor a directory.")
-		glog.Error(err.Error())
-		return err
+		if name == control.CommandReload {
+			fmt.Println("config reloaded")
+		} else if name == control.CommandStop {
+			fmt.Println(resp.Message)
+			return waitDaemonExit(c)
+		} else if len(resp.Tasks) > 0 {
+			fmt.Printf("task %s: %s requested, now %s\n", resp.Tasks[0].Name, name, resp.Tasks[0].State)
+		}
+		return nil
 	}
-	glog.V(3).Infof("exec robocopy: %v", output)
+}
 
-	return nil
+// formatTime formats t for the commands, "-" for zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04:05")
 }
 
-func (t *Task) start() {
-	glog.Infof("start task %v", t.Name)
-	var interval = time.Now().Sub(t.LastSuccTime)
+// listCommand prints the tasks of the config, the usage is
+// backup list
+func listCommand(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := loadConfig("")
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tMODE\tFORMAT\tRUNS\tSRC\tDST")
+	for i := range c.backupConfig.Tasks {
+		task := &c.backupConfig.Tasks[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", task.Name, task.Mode, task.Format, task.when(), task.Src, task.Dst)
+	}
+	return w.Flush()
+}
 
-	if interval > t.PeriodDuration {
-		glog.Warningf("task %v has not been executed for %v, which is logger than %v, will execute it right now.",
-			t.Name, interval, t.PeriodDuration)
-		if err := t.work(); err != nil {
-			glog.Error(err.Error())
-		}
-	} else {
-		firstWait := make(chan string, 1)
-		go func() {
-			time.Sleep(t.PeriodDuration - interval)
-			firstWait <- "now"
-		}()
+// validateCommand validates the config file, by default backup.yaml of the user. The usage is
+// backup validate [config file]
+func validateCommand(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New("usage: backup validate [config file]")
+	}
+	c, err := loadConfig(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("config %s is valid, %d tasks\n", c.configFilePath, len(c.backupConfig.Tasks))
+	return nil
+}
 
-		select {
-		case <-t.stopCh:
-			glog.Warning("task " + t.Name + " stopped.")
-			return
-		case <-firstWait:
-			err := t.work()
-			if err != nil {
-				glog.Error(err.Error())
-			}
-		}
+// snapshotsCommand prints the snapshots of a task in snapshot mode or repository format, oldest first,
+// or only the ones its retention would prune with -prune-dry-run. The usage is
+// backup snapshots [-prune-dry-run] <task name>
+func snapshotsCommand(args []string) error {
+	fs := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	pruneDryRun := fs.Bool("prune-dry-run", false, "list the snapshots the retention of the task would prune, without pruning them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: backup snapshots [-prune-dry-run] <task name>")
+	}
+	c, err := loadConfig("")
+	if err != nil {
+		return err
+	}
+	task := c.findTask(fs.Arg(0))
+	if task == nil {
+		return errors.New("task " + fs.Arg(0) + " not found")
 	}
 
-	t.ticker = time.Tick(t.PeriodDuration)
-	for {
-		select {
-		case <-t.stopCh:
-			glog.Warning("task " + t.Name + " stopped.")
-			return
-		case <-t.ticker:
-			err := t.work()
-			if err != nil {
-				glog.Error(err.Error())
-				continue
-			}
+	snapshots, err := task.snapshots()
+	if err != nil {
+		return err
+	}
+	if *pruneDryRun {
+		if task.Retention == nil {
+			return errors.New("task " + task.Name + " has no retention, no snapshot is pruned")
+		}
+		_, snapshots = task.Retention.Apply(snapshots, time.Now())
+		if len(snapshots) == 0 {
+			fmt.Printf("task %s: no snapshot would be pruned\n", task.Name)
+			return nil
 		}
 	}
-}
-
-func (t *Task) equals(task Task) bool {
-	if strings.EqualFold(filepath.Clean(t.Src), filepath.Clean(task.Src)) &&
-		strings.EqualFold(filepath.Clean(t.Dst), filepath.Clean(task.Dst)) {
-		return true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tTIME")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\n", s.Name, formatTime(s.Time))
 	}
-	return false
+	return w.Flush()
 }
 
 type Config struct {
+	// serializes the writes of the status file
+	statusMu sync.Mutex
 	//indicate backup.yaml file update
 	updateConfigFile chan string
 	backupConfig     BackupConfig
@@ -238,6 +2467,10 @@ type Config struct {
 	//indicate backupConfig struct update
 	updateBackupConfig chan string
 	statusFilePath     string
+	// reload requests of the control endpoint, replied with the parse error
+	reload chan chan error
+	// stop requests of the control endpoint
+	stop chan struct{}
 }
 
 func (c *Config) Init() error {
@@ -246,11 +2479,17 @@ func (c *Config) Init() error {
 		glog.Errorf("get current user failed: %v", err)
 		return err
 	}
-	c.configFilePath = filepath.Join(u.HomeDir, "Documents", "backup", "backup.yaml")
-	c.statusFilePath = filepath.Join(u.HomeDir, "Documents", "backup", "backup_status.yaml")
+	dir := configDir
+	if dir == "" {
+		dir = filepath.Join(u.HomeDir, "Documents", "backup")
+	}
+	c.configFilePath = filepath.Join(dir, "backup.yaml")
+	c.statusFilePath = filepath.Join(dir, "backup_status.yaml")
 	c.updateTime = time.Time{}
 	c.updateConfigFile = make(chan string, 10)
 	c.updateBackupConfig = make(chan string, 10)
+	c.reload = make(chan chan error)
+	c.stop = make(chan struct{}, 1)
 	c.backupConfig = BackupConfig{}
 	return nil
 }
@@ -274,6 +2513,9 @@ func (c *Config) Parse() error {
 	}
 
 	for index := range bc.Tasks {
+		if bc.Tasks[index].schedule != nil || len(bc.Tasks[index].After) > 0 {
+			continue
+		}
 		if duration, err := util.ParseDuration(bc.Tasks[index].PeriodString); err != nil {
 			glog.Error(err.Error())
 			return err
@@ -299,17 +2541,60 @@ func (c *Config) Parse() error {
 				if bc.Tasks[i].equals(bs.Tasks[j]) {
 					bc.Tasks[i].LastSuccTime = bs.Tasks[j].LastSuccTime
 					bc.Tasks[i].RecentResult = bs.Tasks[j].RecentResult
+					bc.Tasks[i].LastError = bs.Tasks[j].LastError
+					bc.Tasks[i].LastCheckTime = bs.Tasks[j].LastCheckTime
+					bc.Tasks[i].RecentCheckResult = bs.Tasks[j].RecentCheckResult
 				}
 			}
 		}
 	}
 
+	for i := range bc.Tasks {
+		bc.Tasks[i].lockFile = filepath.Join(filepath.Dir(c.statusFilePath), "locks", lockName(bc.Tasks[i].Name))
+	}
+
 	c.backupConfig = bc
 	c.updateBackupConfig <- "updated"
 	glog.Warning("updateBackupConfig signal send")
 	return nil
 }
 
+// lockName return the name of the lock file of the task name
+func lockName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name)) + ".lock"
+}
+
+// loadConfig parses the config file at path, or backup.yaml of the user if path is empty,
+// with the status of the tasks
+func loadConfig(path string) (*Config, error) {
+	var c Config
+	if err := c.Init(); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		c.configFilePath = path
+	}
+	if err := c.Parse(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// findTask return the task with the name, or nil if not found
+func (c *Config) findTask(name string) *Task {
+	for i := range c.backupConfig.Tasks {
+		if strings.EqualFold(c.backupConfig.Tasks[i].Name, name) {
+			return &c.backupConfig.Tasks[i]
+		}
+	}
+	return nil
+}
+
 func (c *Config) Monit() {
 	glog.Info("Start monit backup config...")
 	for {
@@ -336,6 +2621,13 @@ func (c *Config) Update() {
 				glog.Errorf("parse backup config error: %v, will continue use old config: %+v",
 					err.Error(), c.backupConfig)
 			}
+		case reply := <-c.reload:
+			glog.Warning("receive reload request of the control endpoint.")
+			err := c.Parse()
+			if err != nil {
+				glog.Errorf("parse backup config error: %v, will continue use old config", err.Error())
+			}
+			reply <- err
 		case <-BackupStatusCh:
 			glog.V(3).Info("receive backup status update signal")
 			if err := c.UpdateStatus(); err != nil {
@@ -346,20 +2638,273 @@ func (c *Config) Update() {
 }
 
 func (c *Config) UpdateStatus() error {
-	data, err := yaml.Marshal(c.backupConfig)
+	// the status of the running tasks, which may be older than the config if it failed to reload
+	return c.writeStatus(RunningTasks.List())
+}
+
+// writeStatus writes the config with the status of the tasks into the status file
+func (c *Config) writeStatus(tasks []Task) error {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	status := c.backupConfig
+	status.Tasks = tasks
+	data, err := yaml.Marshal(status)
 	if err != nil {
 		glog.Error(err)
 	}
-	err = ioutil.WriteFile(c.statusFilePath, data, os.ModePerm)
+	// write a temporary file and rename it, so the status file is never half written
+	tmp := c.statusFilePath + values.TempFileSuffix
+	err = ioutil.WriteFile(tmp, data, os.ModePerm)
+	if err == nil {
+		err = os.Rename(tmp, c.statusFilePath)
+	}
 	if err != nil {
 		glog.Error(err)
 	}
 	return nil
 }
 
+// controlConfig return the control config, with the default socket beside the config file
+func (c *Config) controlConfig() ControlConfig {
+	var cc ControlConfig
+	if c.backupConfig.Control != nil {
+		cc = *c.backupConfig.Control
+	}
+	if cc.Socket == "" {
+		cc.Socket = filepath.Join(filepath.Dir(c.configFilePath), "backup.sock")
+	}
+	return cc
+}
+
+// handleControl handles the requests of the control endpoint, restoreRoot is the restore_root of its config
+func (c *Config) handleControl(req control.Request, restoreRoot string) (*control.Response, error) {
+	switch req.Command {
+	case control.CommandStatus:
+		return &control.Response{Tasks: RunningTasks.Status()}, nil
+	case control.CommandReload:
+		reply := make(chan error)
+		c.reload <- reply
+		return nil, <-reply
+	case control.CommandStop:
+		// the daemon is already shutting down if a stop is pending
+		select {
+		case c.stop <- struct{}{}:
+		default:
+		}
+		return &control.Response{Message: "the daemon will stop once the runs in progress finished"}, nil
+	case control.CommandTrigger, control.CommandPause, control.CommandResume:
+	case control.CommandSnapshots, control.CommandFiles, control.CommandRestore:
+	default:
+		return nil, errors.New("unknown command " + req.Command)
+	}
+
+	t := RunningTasks.find(req.Task)
+	if t == nil {
+		return nil, errors.New("task " + req.Task + " not found")
+	}
+	var err error
+	switch req.Command {
+	case control.CommandSnapshots, control.CommandFiles, control.CommandRestore:
+		return t.browse(req, restoreRoot)
+	case control.CommandTrigger:
+		err = t.control.Trigger()
+	case control.CommandPause:
+		if !t.control.Pause() {
+			err = errors.New("the task is already paused")
+		}
+	case control.CommandResume:
+		if !t.control.Resume() {
+			err = errors.New("the task is not paused")
+		}
+	}
+	if err == nil {
+		glog.Warningf("task %v: %v requested by the control endpoint", t.Name, req.Command)
+	}
+	status := t.copy()
+	return &control.Response{Tasks: []control.TaskStatus{status.status(time.Now())}}, err
+}
+
+// browse handles the requests of the control endpoint to the snapshots of the task,
+// files can only be restored under the src of the task or restoreRoot
+func (t *Task) browse(req control.Request, restoreRoot string) (*control.Response, error) {
+	resp := &control.Response{}
+	if req.Command == control.CommandSnapshots {
+		snapshots, err := t.snapshots()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range snapshots {
+			resp.Snapshots = append(resp.Snapshots, control.Snapshot{Name: s.Name, Time: s.Time})
+		}
+		return resp, nil
+	}
+
+	src, origin, err := t.restoreSource(time.Time{}, req.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if req.Command == control.CommandFiles {
+		files, err := src.Files()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range restore.List(files, req.Dir) {
+			resp.Files = append(resp.Files, control.FileEntry{Name: e.Name, Dir: e.Dir, Size: e.Size, ModTime: e.ModTime})
+		}
+		return resp, nil
+	}
+
+	opts := restore.Options{Target: origin, Globs: req.Globs, Paths: req.Paths, Conflict: req.Conflict}
+	if req.Target != "" {
+		if !filepath.IsAbs(req.Target) {
+			return nil, errors.New("restore target " + req.Target + " should be an absolute path")
+		}
+		opts.Target = filepath.Clean(req.Target)
+		if !util.IsWithin(origin, opts.Target) && (restoreRoot == "" || !util.IsWithin(restoreRoot, opts.Target)) {
+			return nil, errors.New("restore target " + opts.Target + " should be under " + origin +
+				" or the restore_root of the control config")
+		}
+	}
+	glog.Warningf("task %v: restore %v %v into %v requested by the control endpoint", t.Name, req.Globs, req.Paths,
+		opts.Target)
+	summary, err := restore.Restore(src, opts)
+	if summary != nil {
+		resp.Message = summary.String()
+		glog.Infof("task %v restored to %v: %v", t.Name, opts.Target, summary)
+	}
+	return resp, err
+}
+
+// controlEndpoint is the control endpoint of the daemon with its REST api and dashboard,
+// it is restarted when its config changes
+type controlEndpoint struct {
+	server *control.Server
+	http   *http.Server
+	config ControlConfig
+}
+
+func (e *controlEndpoint) update(c *Config) {
+	cc := c.controlConfig()
+	if e.server != nil && cc == e.config {
+		return
+	}
+	e.close()
+	handler := func(req control.Request) (*control.Response, error) {
+		return c.handleControl(req, cc.RestoreRoot)
+	}
+	server, err := control.Listen(cc.Socket, cc.Address, cc.Token, handler)
+	if err != nil {
+		glog.Errorf("start control endpoint failed: %v", err)
+		return
+	}
+	glog.Infof("control endpoint listens on %v %v", cc.Socket, cc.Address)
+	e.server, e.config = server, cc
+	if cc.HTTPAddress == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", control.APIHandler(handler, cc.Token))
+	mux.Handle("/", dashboard.Handler())
+	if e.http, err = control.ListenHTTP(cc.HTTPAddress, mux); err != nil {
+		glog.Errorf("start http api failed: %v", err)
+		return
+	}
+	glog.Infof("http api and dashboard listen on %v", cc.HTTPAddress)
+}
+
+func (e *controlEndpoint) close() {
+	if e.server == nil {
+		return
+	}
+	if err := e.server.Close(); err != nil {
+		glog.Error(err)
+	}
+	e.server = nil
+	if e.http != nil {
+		if err := e.http.Close(); err != nil {
+			glog.Error(err)
+		}
+		e.http = nil
+	}
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	defer glog.Flush()
+
+	var command func(args []string) error
+	switch flag.Arg(0) {
+	case "", "daemon":
+		if flag.NArg() > 1 {
+			fmt.Fprintln(os.Stderr, "usage: backup [flags] daemon")
+			os.Exit(ExitFailed)
+		}
+		code := daemon()
+		glog.Flush()
+		os.Exit(code)
+	case "run":
+		command = runCommand
+	case "status":
+		command = statusCommand
+	case "list":
+		command = listCommand
+	case "validate":
+		command = validateCommand
+	case "snapshots":
+		command = snapshotsCommand
+	case control.CommandTrigger, control.CommandPause, control.CommandResume, control.CommandReload, control.CommandStop:
+		command = controlCommand(flag.Arg(0))
+	case "restore":
+		command = restoreCommand
+	case "check":
+		command = checkCommand
+	case "help":
+		flag.Usage()
+		return
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command "+flag.Arg(0))
+		flag.Usage()
+		os.Exit(ExitFailed)
+	}
+	if err := command(flag.Args()[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		glog.Flush()
+		os.Exit(ExitFailed)
+	}
+}
+
+// usage prints the commands and the flags of the backup binary
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), `usage: backup [flags] [command] [args]
+
+commands:
+  daemon      run the tasks by their schedules and periods, the default command
+  run         run a task once right now
+  status      show the state, last success, next run and recent results of the tasks
+  list        list the tasks of the config
+  validate    validate the config
+  snapshots   list the snapshots of a task
+  restore     restore files from the backup of a task
+  check       check the repositories of the tasks
+  trigger     ask the daemon to run a task right now
+  pause       ask the daemon to defer the runs of a task until it is resumed
+  resume      ask the daemon to resume a paused task
+  reload      ask the daemon to reload the config
+  stop        ask the daemon to shut down once the runs in progress finished, and wait for it
+
+Run "backup <command> -h" for the arguments of a command.
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+// daemon runs the tasks until the process is asked to stop by a signal, and return the exit code
+func daemon() int {
 	glog.Info("start backup process")
 
 	BackupStatusCh = make(chan string, 100)
@@ -367,31 +2912,78 @@ func main() {
 	var c Config
 	if err := c.Init(); err != nil {
 		glog.Fatal("init config error: ", err.Error())
-		return
+		return ExitFailed
 	}
 
 	go c.Monit()
 	go c.Update()
 
-	mainLoop(&c)
+	code := mainLoop(&c)
+	glog.Infof("backup process exits with code %d", code)
+	return code
 }
 
-func mainLoop(c *Config) {
+// mainLoop applies config updates to the running tasks until the process is asked to stop by a signal or a stop request,
+// and return the exit code
+func mainLoop(c *Config) int {
 	glog.Info("Start main loop...")
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	var endpoint controlEndpoint
+	defer endpoint.close()
 	for {
-		var tasks []Task
-		tasks = c.backupConfig.Tasks
-		for index := range tasks {
-			tasks[index].stopCh = make(chan string, 1)
-			go tasks[index].start()
+		select {
+		case <-c.updateBackupConfig:
+			glog.Warning("backup config updated, will restart the changed tasks.")
+			TaskQueue.SetLimit(c.backupConfig.MaxConcurrentTasks)
+			RunningTasks.Update(c.backupConfig.Tasks)
+			endpoint.update(c)
+		case sig := <-sigCh:
+			glog.Warningf("received %v, will shut down.", sig)
+			return shutdown(c, sigCh)
+		case <-c.stop:
+			glog.Warning("receive stop request of the control endpoint, will shut down.")
+			return shutdown(c, sigCh)
 		}
+	}
+}
+
+// shutdown stops starting runs and waits for the runs in progress to finish in the grace period.
+// The runs not finished by then, or at a second signal, are interrupted. The status is saved at last.
+func shutdown(c *Config, sigCh chan os.Signal) int {
+	code := ExitOK
+	drained := RunningTasks.Drain()
+	grace := c.backupConfig.shutdownGrace
+	if grace == 0 {
+		grace = values.DefaultShutdownGrace
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+		glog.Warningf("runs in progress not finished in %v, will interrupt them.", grace)
+	case sig := <-sigCh:
+		glog.Warningf("received %v again, will interrupt the runs in progress.", sig)
+	}
+	RunningTasks.Stop(errShutdown)
 
+	select {
+	case <-drained:
+	default:
+		code = ExitInterrupted
+		// the runs stop at their next file or read, a run blocked in the system is left behind
+		wait := time.NewTimer(values.ShutdownInterruptWait)
+		defer wait.Stop()
 		select {
-		case <-c.updateBackupConfig:
-			glog.Warning("backup config updated, will restart all tasks.")
-			for index := range tasks {
-				tasks[index].stopCh <- "stop"
-			}
+		case <-drained:
+		case <-wait.C:
+			glog.Errorf("runs in progress not stopped in %v, exit anyway.", values.ShutdownInterruptWait)
 		}
 	}
+
+	if err := c.UpdateStatus(); err != nil {
+		glog.Error("UpdateStatus error: ", err.Error())
+	}
+	return code
 }
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"control"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"snapshot"
+	"strings"
+	"testing"
+	"time"
+	"util"
+)
+
+// testTask return a task run every hour, which last succeeded right now
+func testTask(name, src string) Task {
+	return Task{Name: name, Src: src, Dst: "/backup", PeriodString: "1h", PeriodDuration: time.Hour,
+		LastSuccTime: time.Now()}
+}
+
+func TestFingerprint(t *testing.T) {
+	a, b := testTask("docs", "/data/docs"), testTask("docs", "/data/docs")
+	b.LastSuccTime, b.RecentResult, b.LastError = time.Now().Add(-time.Hour), []string{"fail"}, "fail"
+	if a.fingerprint() != b.fingerprint() {
+		t.Error("the status should not change the fingerprint")
+	}
+	b.Src = "/data/music"
+	if a.fingerprint() == b.fingerprint() {
+		t.Error("the config should change the fingerprint")
+	}
+}
+
+func TestTaskSetUpdate(t *testing.T) {
+	s := &taskSet{}
+	defer s.Stop(nil)
+	s.Update([]Task{testTask("docs", "/data/docs"), testTask("music", "/data/music")})
+	docs, music := s.find("docs"), s.find("music")
+	if docs == nil || music == nil {
+		t.Fatal("tasks not started")
+	}
+	music.RecentResult = []string{"2020-01-02 03:04:05 success"}
+	music.control.Pause()
+
+	modified := testTask("music", "/data/music2")
+	modified.LastSuccTime = time.Time{}
+	s.Update([]Task{testTask("docs", "/data/docs"), modified, testTask("photos", "/data/photos")})
+	if s.find("docs") != docs || docs.ctx.Err() != nil {
+		t.Error("unchanged task should keep running")
+	}
+	m := s.find("music")
+	if m == music || music.ctx.Err() == nil || m.ctx.Err() != nil {
+		t.Error("modified task should be restarted")
+	}
+	if status := m.copy(); status.LastSuccTime != music.LastSuccTime || len(status.RecentResult) != 1 ||
+		m.control.state() != "paused" {
+		t.Errorf("modified task should keep its status, got %v %v %v", status.LastSuccTime, status.RecentResult,
+			m.control.state())
+	}
+	if s.find("photos") == nil {
+		t.Error("new task should be started")
+	}
+
+	s.Update([]Task{testTask("photos", "/data/photos")})
+	if docs.ctx.Err() == nil || m.ctx.Err() == nil || len(s.List()) != 1 {
+		t.Error("removed tasks should be stopped")
+	}
+}
+
+func TestTaskSetUpdateRunning(t *testing.T) {
+	BackupStatusCh = make(chan string, 100)
+	defer func() { BackupStatusCh = nil }()
+	s := &taskSet{}
+	defer s.Stop(nil)
+	s.Update([]Task{testTask("docs", "/data/docs")})
+	docs := s.find("docs")
+
+	// a run in progress, which succeeds once released
+	release, finished := make(chan struct{}), make(chan error)
+	go docs.run("task docs", true, func() (err error) {
+		ctx, cancel := docs.runContext()
+		defer cancel()
+		<-release
+		err = ctx.Err()
+		docs.dealResult(ctx, &err)
+		finished <- err
+		return err
+	})
+	for docs.control.state() != "running" {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	modified := testTask("docs", "/data/docs2")
+	s.Update([]Task{modified})
+	m := s.find("docs")
+	if m == docs || docs.ctx.Err() == nil || m.control.state() != "running" {
+		t.Fatal("modified task should replace the task, and keep its run in progress")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if status := m.copy(); len(status.RecentResult) != 0 {
+		t.Fatalf("modified task should not start before the run finished: %v", status.RecentResult)
+	}
+	close(release)
+	if err := <-finished; err != nil {
+		t.Fatalf("the run should not be interrupted by the modification: %v", err)
+	}
+	var recent []string
+	for i := 0; i < 100 && len(recent) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		recent = m.copy().RecentResult
+	}
+	if len(recent) != 1 || !strings.Contains(recent[0], "success") {
+		t.Errorf("the result of the run should be kept by the modified task: %v", recent)
+	}
+
+	// a run in progress of a modified task is interrupted when the task is removed
+	m.run("task docs", true, func() error {
+		ctx, cancel := m.runContext()
+		defer cancel()
+		s.Update([]Task{testTask("docs", "/data/docs3")})
+		s.Update(nil)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Error("the run should be cancelled once the task is removed")
+		}
+		return ctx.Err()
+	})
+}
+
+// run with -race, the status is written by the runs while the status file and control endpoint read it
+func TestTaskStatusConcurrent(t *testing.T) {
+	BackupStatusCh = make(chan string, 100)
+	defer func() { BackupStatusCh = nil }()
+	s := &taskSet{}
+	defer s.Stop(nil)
+	s.Update([]Task{testTask("docs", "/data/docs")})
+	task := s.find("docs")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			err := errors.New("copy failed")
+			task.setRunOutput("output")
+			task.dealResult(context.Background(), &err)
+			<-BackupStatusCh
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		s.Status()
+		task.fingerprint()
+	}
+	<-done
+	status := s.Status()
+	if len(status) != 1 || len(status[0].RecentResult) != 20 || status[0].LastError == "" {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	for _, c := range []struct {
+		after map[string][]string
+		err   string
+	}{
+		{map[string][]string{"offsite": {"docs", "music"}, "archive": {"Offsite"}}, ""},
+		{map[string][]string{"docs": {"offsite"}, "offsite": {"music"}, "music": {"docs"}}, "cycle"},
+		{map[string][]string{"docs": {"docs"}}, "cycle"},
+		{map[string][]string{"offsite": {"photos"}}, "no such task"},
+	} {
+		bc := &BackupConfig{}
+		for _, name := range []string{"docs", "music", "offsite", "archive"} {
+			task := testTask(name, "/data/"+name)
+			task.After = c.after[name]
+			bc.Tasks = append(bc.Tasks, task)
+		}
+		err := bc.validateDependencies()
+		if (err == nil) != (c.err == "") || (err != nil && !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("after %v: %v, want %v", c.after, err, c.err)
+		}
+	}
+}
+
+func TestPrerequisites(t *testing.T) {
+	ready := func(p *prerequisites) bool {
+		select {
+		case <-p.ready:
+			return true
+		default:
+			return false
+		}
+	}
+	p := newPrerequisites([]string{"Docs", "music"})
+	p.succeeded("docs")
+	p.failed("photos")
+	p.succeeded("music")
+	if !ready(p) {
+		t.Error("should be ready after all prerequisites succeeded")
+	}
+
+	p.succeeded("docs")
+	p.failed("music")
+	p.succeeded("music")
+	if ready(p) {
+		t.Error("a success before a failure of a prerequisite should not count")
+	}
+	p.succeeded("docs")
+	p.reset()
+	p.succeeded("music")
+	if ready(p) {
+		t.Error("a success before the task ran should not count")
+	}
+}
+
+func TestTaskChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	BackupStatusCh = make(chan string, 100)
+	defer func() { BackupStatusCh = nil }()
+	src := filepath.Join(dir, "docs")
+	os.MkdirAll(src, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+
+	docs := testTask("docs", src)
+	docs.Dst = filepath.Join(dir, "backup")
+	offsite := Task{Name: "offsite", Src: docs.Dst, Dst: filepath.Join(dir, "offsite"), After: []string{"docs"}}
+	RunningTasks.Update([]Task{docs, offsite})
+	defer RunningTasks.Update(nil)
+	if err = RunningTasks.find("docs").control.Trigger(); err != nil {
+		t.Fatal(err)
+	}
+	// offsite is done once it records its result
+	var recent []string
+	for i := 0; i < 100 && len(recent) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		recent = RunningTasks.Status()[1].RecentResult
+	}
+	if len(recent) == 0 || !strings.Contains(recent[0], "success") {
+		t.Fatalf("offsite should run after docs succeeded: %v", recent)
+	}
+	if !util.Exists(filepath.Join(offsite.Dst, "backup", "docs", "a.txt")) {
+		t.Error("offsite did not copy the backup of docs")
+	}
+}
+
+// testConfigDir writes the config into a temporary directory used as configDir, it return the directory
+func testConfigDir(t *testing.T, config string) string {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDir = dir
+	t.Cleanup(func() {
+		configDir = ""
+		os.RemoveAll(dir)
+	})
+	if err = ioutil.WriteFile(filepath.Join(dir, "backup.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCommands(t *testing.T) {
+	data, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	src, dst := filepath.Join(data, "docs"), filepath.Join(data, "backup")
+	os.MkdirAll(src, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+	dir := testConfigDir(t, "tasks:\n  - name: docs\n    src: "+src+"\n    dst: "+dst+"\n    period: 1d\n")
+
+	if err := validateCommand(nil); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+	if err := validateCommand([]string{"a.yaml", "b.yaml"}); err == nil {
+		t.Error("validate with two files should fail")
+	}
+	if err := validateCommand([]string{filepath.Join(dir, "missing.yaml")}); err == nil {
+		t.Error("validate a missing file should fail")
+	}
+	if err := listCommand(nil); err != nil {
+		t.Errorf("list: %v", err)
+	}
+	if err := snapshotsCommand([]string{"docs"}); err == nil {
+		t.Error("snapshots of a task in copy mode should fail")
+	}
+	if err := statusCommand([]string{"music"}); err == nil {
+		t.Error("status of an unknown task should fail")
+	}
+
+	if err := runCommand([]string{"docs"}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if !util.Exists(filepath.Join(dst, "docs", "a.txt")) {
+		t.Error("run did not copy the files")
+	}
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recent := c.findTask("docs").RecentResult; len(recent) != 1 || !strings.Contains(recent[0], "success") {
+		t.Errorf("run result not in the status file: %v", recent)
+	}
+	if err = statusCommand([]string{"docs"}); err != nil {
+		t.Errorf("status: %v", err)
+	}
+
+	// a task running in another process is not run again
+	lock, err := util.LockFile(filepath.Join(dir, "locks", "docs.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runCommand([]string{"docs"}); err == nil || !strings.Contains(err.Error(), "another backup process") {
+		t.Errorf("run of a locked task: %v", err)
+	}
+	lock.Unlock()
+	if c, err = loadConfig(""); err != nil || len(c.findTask("docs").RecentResult) != 1 {
+		t.Errorf("a refused run should not be recorded: %v", err)
+	}
+
+	// with the daemon running, the run is requested from it
+	var requests []control.Request
+	server, err := control.Listen(filepath.Join(dir, "backup.sock"), "", "", func(req control.Request) (*control.Response, error) {
+		requests = append(requests, req)
+		return &control.Response{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err = runCommand([]string{"docs"}); err != nil {
+		t.Fatalf("run with the daemon: %v", err)
+	}
+	if len(requests) != 1 || requests[0].Command != control.CommandTrigger || requests[0].Task != "docs" {
+		t.Errorf("run should trigger the task in the daemon: %+v", requests)
+	}
+	if c, err = loadConfig(""); err != nil || len(c.findTask("docs").RecentResult) != 1 {
+		t.Errorf("the task should not run in this process with the daemon running: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir := testConfigDir(t, "tasks: []\n")
+	c := &Config{}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	c.backupConfig.shutdownGrace = 200 * time.Millisecond
+	defer func(s *taskSet) { RunningTasks = s }(RunningTasks)
+
+	// a run finished in the grace period
+	RunningTasks = &taskSet{}
+	RunningTasks.beginRun()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		RunningTasks.endRun()
+	}()
+	start := time.Now()
+	if code := shutdown(c, make(chan os.Signal)); code != ExitOK {
+		t.Errorf("exit code %d, want %d", code, ExitOK)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("shutdown should wait for the runs in progress")
+	}
+	if RunningTasks.beginRun() {
+		t.Error("no run should start once drained")
+	}
+	if !util.Exists(filepath.Join(dir, "backup_status.yaml")) {
+		t.Error("the status should be saved")
+	}
+
+	// a run interrupted after the grace period
+	BackupStatusCh = make(chan string, 100)
+	defer func() { BackupStatusCh = nil }()
+	RunningTasks = &taskSet{}
+	RunningTasks.Update([]Task{testTask("docs", "/data/docs")})
+	task := RunningTasks.find("docs")
+	RunningTasks.beginRun()
+	go func() {
+		<-task.ctx.Done()
+		RunningTasks.endRun()
+	}()
+	start = time.Now()
+	if code := shutdown(c, make(chan os.Signal)); code != ExitInterrupted {
+		t.Errorf("exit code %d, want %d", code, ExitInterrupted)
+	}
+	if time.Since(start) < c.backupConfig.shutdownGrace {
+		t.Error("shutdown should wait for the grace period")
+	}
+	if context.Cause(task.ctx) != errShutdown {
+		t.Errorf("the run should be stopped by the shutdown: %v", context.Cause(task.ctx))
+	}
+}
+
+func TestStopRequest(t *testing.T) {
+	testConfigDir(t, "tasks: []\n")
+	c := &Config{}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.handleControl(control.Request{Command: control.CommandStop}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-c.stop:
+	default:
+		t.Fatal("stop should be requested")
+	}
+	if err := controlCommand(control.CommandStop)([]string{"docs"}); err == nil {
+		t.Error("stop should take no task")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	for _, c := range []struct {
+		mode, format string
+		retention    bool
+		err          bool
+	}{
+		{"copy", "", true, true},
+		{"mirror", "", true, true},
+		{"snapshot", "", true, false},
+		{"", "repository", true, false},
+		{"copy", "", false, false},
+	} {
+		task := testTask("docs", "/data/docs")
+		task.Mode, task.Format = c.mode, c.format
+		if c.retention {
+			task.Retention = &snapshot.Retention{KeepLast: 3}
+		}
+		bc := &BackupConfig{Tasks: []Task{task}, DefaultRetention: &snapshot.Retention{KeepDaily: 7}}
+		if err := bc.Validate(); (err != nil) != c.err {
+			t.Errorf("retention of %s mode %s format: %v", c.mode, c.format, err)
+		} else if err == nil && !c.retention && bc.Tasks[0].Retention != nil {
+			t.Errorf("default retention should not apply to %s mode", c.mode)
+		}
+	}
+}
+
+func TestSnapshotsPruneDryRun(t *testing.T) {
+	data, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	src, dst := filepath.Join(data, "docs"), filepath.Join(data, "backup")
+	names := []string{"2020-01-01_000000", "2020-01-02_000000", "2020-01-03_000000"}
+	for _, name := range names {
+		os.MkdirAll(filepath.Join(dst, "docs", name), os.ModePerm)
+	}
+	os.MkdirAll(src, os.ModePerm)
+	config := "tasks:\n  - name: docs\n    src: " + src + "\n    dst: " + dst + "\n    period: 1d\n    mode: snapshot\n"
+	dir := testConfigDir(t, config)
+	if err = snapshotsCommand([]string{"-prune-dry-run", "docs"}); err == nil {
+		t.Error("prune dry run of a task without retention should fail")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "backup.yaml"), []byte(config+"    retention:\n      keep_last: 1\n"), 0644)
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	err = snapshotsCommand([]string{"-prune-dry-run", "docs"})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), names[0]) || !strings.Contains(string(out), names[1]) ||
+		strings.Contains(string(out), names[2]) {
+		t.Errorf("should list the snapshots but the newest one, got\n%s", out)
+	}
+	for _, name := range names {
+		if !util.Exists(filepath.Join(dst, "docs", name)) {
+			t.Errorf("snapshot %s should not be pruned", name)
+		}
+	}
+}
+
+func TestValidateRepositoryTasks(t *testing.T) {
+	for _, c := range []struct {
+		names [2]string
+		dsts  [2]string
+		err   bool
+	}{
+		{[2]string{"a/b", "A_b"}, [2]string{"/backup", "/backup/"}, true},
+		{[2]string{"docs", "docs"}, [2]string{"/backup", "/backup"}, true},
+		{[2]string{"a/b", "a_b"}, [2]string{"/backup", "/backup2"}, false},
+		{[2]string{"a/b", "a_c"}, [2]string{"/backup", "/backup"}, false},
+	} {
+		bc := &BackupConfig{}
+		for i := range c.names {
+			task := testTask(c.names[i], "/data/"+c.names[i])
+			task.Dst, task.Format = c.dsts[i], "repository"
+			bc.Tasks = append(bc.Tasks, task)
+		}
+		if err := bc.Validate(); (err != nil) != c.err {
+			t.Errorf("tasks %v to %v: %v", c.names, c.dsts, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,7 +9,6 @@ import (
 	"path/filepath"
 	"strings"
 	"util"
-	"values"
 )
 
 func main() {
@@ -51,22 +51,27 @@ func main() {
 		}
 	}
 
+	currDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		fmt.Printf("get current dir failed: %v", err)
+		return
+	}
+
 	isBackupRunning, err := util.IsProcessRunning("backup.exe")
 	if err != nil {
 		fmt.Printf("check whether backup is running error: %v", err)
 	}
 	if isBackupRunning {
-		output, err := util.RunCommand("taskkill", "/IM", "backup.exe")
+		// let the runs in progress finish, taskkill without /F can't stop a process without a window
+		fmt.Println("stopping the running backup, waiting for the runs in progress...")
+		output, err := util.RunCommand(filepath.Join(currDir, "backup.exe"), "stop")
 		if err != nil {
-			fmt.Printf("kill backup failed: %v, \n%v", err, output)
+			fmt.Printf("stop backup failed: %v, \n%v\nwill kill it.\n", err, output)
+			if output, err = util.RunCommand("taskkill", "/F", "/IM", "backup.exe"); err != nil {
+				fmt.Printf("kill backup failed: %v, \n%v", err, output)
+			}
 		}
 	}
-
-	currDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		fmt.Printf("get current dir failed: %v", err)
-		return
-	}
 	programDir := filepath.Join(installPath, "backup")
 	if util.Exists(programDir) {
 		err = os.RemoveAll(programDir)
@@ -80,7 +85,7 @@ func main() {
 			return
 		}
 	}
-	_, err = util.RunCommandWithRetry(values.RobocopyRetryCount, "robocopy", currDir, programDir, "/e")
+	_, err = util.RunRobocopyWithRetry(context.Background(), util.CommandRetryPolicy, currDir, programDir, "/e")
 	if err != nil {
 		fmt.Printf("can't copy program file to install path: %v", err)
 		return
@@ -109,7 +114,7 @@ func main() {
 
 	backupConfigFile := filepath.Join(documentFilePath, "backup.yaml")
 	if !util.Exists(backupConfigFile) {
-		if output, err := util.RunCommandWithRetry(values.RobocopyRetryCount, "robocopy", filepath.Join(currDir, "conf"), documentFilePath); err != nil {
+		if output, err := util.RunRobocopyWithRetry(context.Background(), util.CommandRetryPolicy, filepath.Join(currDir, "conf"), documentFilePath); err != nil {
 			fmt.Printf("cp config files to %s failed: %s", documentFilePath, output)
 			return
 		}
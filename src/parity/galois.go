@@ -0,0 +1,150 @@
+package parity
+
+// arithmetic of GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d)
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func galMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func galDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+func galExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// mulAdd does out ^= c * in
+func mulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i, b := range in {
+			out[i] ^= b
+		}
+		return
+	}
+	logC := int(logTable[c])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= expTable[logC+int(logTable[b])]
+		}
+	}
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func identity(n int) matrix {
+	m := newMatrix(n, n)
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// vandermonde return the rows x cols matrix with m[r][c] = r^c
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = galExp(byte(r), c)
+		}
+	}
+	return m
+}
+
+func (m matrix) multiply(o matrix) matrix {
+	result := newMatrix(len(m), len(o[0]))
+	for r := range result {
+		for c := range result[r] {
+			var v byte
+			for i := range o {
+				v ^= galMul(m[r][i], o[i][c])
+			}
+			result[r][c] = v
+		}
+	}
+	return result
+}
+
+// invert return the inverse of the square matrix by Gauss-Jordan elimination
+func (m matrix) invert() (matrix, bool) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		if work[c][c] == 0 {
+			swapped := false
+			for r := c + 1; r < n; r++ {
+				if work[r][c] != 0 {
+					work[c], work[r] = work[r], work[c]
+					swapped = true
+					break
+				}
+			}
+			if !swapped {
+				return nil, false
+			}
+		}
+		if scale := work[c][c]; scale != 1 {
+			for i := range work[c] {
+				work[c][i] = galDiv(work[c][i], scale)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				factor := work[r][c]
+				for i := range work[r] {
+					work[r][i] ^= galMul(factor, work[c][i])
+				}
+			}
+		}
+	}
+	result := newMatrix(n, n)
+	for r := range result {
+		copy(result[r], work[r][n:])
+	}
+	return result, true
+}
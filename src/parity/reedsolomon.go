@@ -0,0 +1,129 @@
+package parity
+
+import "errors"
+
+// Encoder is a systematic Reed-Solomon code over GF(2^8): parity shards are computed from data shards,
+// and any data shards lost can be reconstructed as long as no more than parity shards are lost in total.
+type Encoder struct {
+	data, parity int
+	// (data + parity) x data, the top data rows are the identity
+	matrix matrix
+}
+
+func New(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil, errors.New("shard counts should be positive")
+	}
+	if dataShards+parityShards > 256 {
+		return nil, errors.New("too many shards, at most 256")
+	}
+	// any data rows of a vandermonde matrix are independent, multiplying by the inverse of the top square keeps
+	// this and makes the code systematic
+	v := vandermonde(dataShards+parityShards, dataShards)
+	top, ok := v[:dataShards].invert()
+	if !ok {
+		return nil, errors.New("singular matrix")
+	}
+	return &Encoder{data: dataShards, parity: parityShards, matrix: v.multiply(top)}, nil
+}
+
+func (e *Encoder) checkShards(shards [][]byte, allowNil bool) (int, error) {
+	if len(shards) != e.data+e.parity {
+		return 0, errors.New("wrong shard count")
+	}
+	size := -1
+	for _, shard := range shards {
+		if shard == nil {
+			if !allowNil {
+				return 0, errors.New("missing shard")
+			}
+			continue
+		}
+		if size == -1 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return 0, errors.New("shards have different sizes")
+		}
+	}
+	if size == -1 {
+		return 0, errors.New("no shard")
+	}
+	return size, nil
+}
+
+// Encode computes the parity shards, shards holds data shards followed by parity shards of the same size
+func (e *Encoder) Encode(shards [][]byte) error {
+	if _, err := e.checkShards(shards, false); err != nil {
+		return err
+	}
+	for p := 0; p < e.parity; p++ {
+		out := shards[e.data+p]
+		for i := range out {
+			out[i] = 0
+		}
+		for d := 0; d < e.data; d++ {
+			mulAdd(e.matrix[e.data+p][d], shards[d], out)
+		}
+	}
+	return nil
+}
+
+// Reconstruct rebuilds the missing (nil) shards
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	size, err := e.checkShards(shards, true)
+	if err != nil {
+		return err
+	}
+	var rows matrix
+	var present [][]byte
+	for i, shard := range shards {
+		if shard != nil && len(rows) < e.data {
+			rows = append(rows, e.matrix[i])
+			present = append(present, shard)
+		}
+	}
+	if len(rows) < e.data {
+		return errors.New("too many shards lost to reconstruct")
+	}
+	decode, ok := rows.invert()
+	if !ok {
+		return errors.New("singular matrix")
+	}
+
+	// data shards are the inverse applied to the present shards
+	for d := 0; d < e.data; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		shards[d] = make([]byte, size)
+		for i, shard := range present {
+			mulAdd(decode[d][i], shard, shards[d])
+		}
+	}
+	for p := 0; p < e.parity; p++ {
+		if shards[e.data+p] != nil {
+			continue
+		}
+		shards[e.data+p] = make([]byte, size)
+		for d := 0; d < e.data; d++ {
+			mulAdd(e.matrix[e.data+p][d], shards[d], shards[e.data+p])
+		}
+	}
+	return nil
+}
+
+// Split splits data into data shards of the same size, the last one is padded with zeros
+func (e *Encoder) Split(data []byte) [][]byte {
+	size := (len(data) + e.data - 1) / e.data
+	if size == 0 {
+		size = 1
+	}
+	shards := make([][]byte, e.data+e.parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < e.data && i*size < len(data) {
+			copy(shards[i], data[i*size:])
+		}
+	}
+	return shards
+}
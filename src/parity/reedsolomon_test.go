@@ -0,0 +1,49 @@
+package parity
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReconstruct(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, c := range []struct{ data, parity int }{{1, 1}, {4, 2}, {20, 3}, {200, 56}} {
+		e, err := New(c.data, c.parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards := e.Split(data)
+		if err = e.Encode(shards); err != nil {
+			t.Fatal(err)
+		}
+		expected := make([][]byte, len(shards))
+		for i := range shards {
+			expected[i] = append([]byte(nil), shards[i]...)
+		}
+
+		// lose as many shards as there are parity shards, data ones first
+		for i := 0; i < c.parity; i++ {
+			shards[(i*7)%len(shards)] = nil
+		}
+		if err = e.Reconstruct(shards); err != nil {
+			t.Fatalf("%+v: %v", c, err)
+		}
+		for i := range shards {
+			if !bytes.Equal(shards[i], expected[i]) {
+				t.Errorf("%+v: shard %d reconstructed wrong", c, i)
+			}
+		}
+		if joined := bytes.Join(shards[:c.data], nil); !bytes.Equal(joined[:len(data)], data) {
+			t.Errorf("%+v: data reconstructed wrong", c)
+		}
+
+		for i := 0; i <= c.parity; i++ {
+			shards[i] = nil
+		}
+		if err = e.Reconstruct(shards); err == nil {
+			t.Errorf("%+v: losing more shards than parity should fail", c)
+		}
+	}
+}
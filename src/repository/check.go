@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"fmt"
+	"glog"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// CheckResult is the result of a repository check
+type CheckResult struct {
+	Snapshots int
+	Blobs     int
+	// blobs read and checked against their ids
+	Read int
+	// manifests that can not be read
+	BadManifests []string
+	// blobs used by snapshots but not stored
+	Missing []string
+	// blobs whose content does not match the id
+	Damaged []string
+	// damaged blobs repaired from their parity
+	Repaired []string
+	// blobs not used by any snapshot, they are removed by the next prune
+	Unused int
+}
+
+// OK report whether no problem is found
+func (c *CheckResult) OK() bool {
+	return len(c.BadManifests) == 0 && len(c.Missing) == 0 && len(c.Damaged) == 0
+}
+
+func (c *CheckResult) String() string {
+	s := fmt.Sprintf("%d snapshots, %d blobs, %d read, %d unused", c.Snapshots, c.Blobs, c.Read, c.Unused)
+	if len(c.Repaired) > 0 {
+		s += fmt.Sprintf(", %d repaired", len(c.Repaired))
+	}
+	if !c.OK() {
+		s += fmt.Sprintf(", %d bad manifests, %d missing blobs, %d damaged blobs",
+			len(c.BadManifests), len(c.Missing), len(c.Damaged))
+	}
+	return s
+}
+
+// Check validates the manifests of all tasks against the stored blobs, and re-reads readPercent (0 ~ 100)
+// of the blobs, chosen randomly, to find the damaged ones.
+func (r *Repository) Check(readPercent float64) (*CheckResult, error) {
+	// hold the read lock, so the blobs are not collected while checking
+	lock := lockOf(r.Root)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	result := &CheckResult{}
+	snapshots, err := r.allManifests()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, s := range snapshots {
+		m, err := r.LoadManifest(s)
+		if err != nil {
+			glog.Errorf("check: %v", err)
+			result.BadManifests = append(result.BadManifests, s.Path)
+			continue
+		}
+		result.Snapshots++
+		for _, n := range m.Files {
+			for _, id := range n.Blobs {
+				used[id] = true
+			}
+		}
+	}
+
+	stored := make(map[string]bool)
+	err = r.walkBlobs(func(id, path string, info os.FileInfo) error {
+		stored[id] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Blobs = len(stored)
+	var ids []string
+	for id := range used {
+		if !stored[id] {
+			result.Missing = append(result.Missing, id)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	result.Unused = len(stored) - len(ids)
+	sort.Strings(result.Missing)
+
+	count := int(float64(len(ids))*readPercent/100 + 0.5)
+	if readPercent > 0 && count == 0 && len(ids) > 0 {
+		count = 1
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	for _, id := range ids[:count] {
+		result.Read++
+		if err := r.readBlob(id); err != nil {
+			glog.Errorf("check: %v", err)
+			if repairErr := r.repairBlob(id); repairErr != nil {
+				glog.Errorf("check: %v", repairErr)
+				result.Damaged = append(result.Damaged, id)
+			} else {
+				result.Repaired = append(result.Repaired, id)
+			}
+		}
+	}
+	sort.Strings(result.Damaged)
+	for _, id := range result.Missing {
+		glog.Errorf("check: blob %s is missing", id)
+	}
+	return result, nil
+}
+
+// readBlob reads the whole blob, which checks it against the id
+func (r *Repository) readBlob(id string) error {
+	b, err := r.OpenBlob(id)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	_, err = io.Copy(ioutil.Discard, b)
+	return err
+}
+
+// Problems return a short description of the problems found, for the status file
+func (c *CheckResult) Problems() string {
+	var problems []string
+	if len(c.BadManifests) > 0 {
+		problems = append(problems, fmt.Sprintf("%d bad manifests", len(c.BadManifests)))
+	}
+	if len(c.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("%d missing blobs", len(c.Missing)))
+	}
+	if len(c.Damaged) > 0 {
+		problems = append(problems, fmt.Sprintf("%d damaged blobs", len(c.Damaged)))
+	}
+	return strings.Join(problems, ", ")
+}
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, os.ModePerm)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		ioutil.WriteFile(filepath.Join(src, name), []byte("content of "+name), 0644)
+	}
+	r, err := Open(filepath.Join(dir, "repo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := r.Backup(context.Background(), "task", src, BackupOptions{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Check(100)
+	if err != nil || !result.OK() || result.Read != 3 || result.Snapshots != 1 {
+		t.Fatalf("check a good repository: %v %v", result, err)
+	}
+
+	damaged, _, _ := r.findBlob(m.Files[0].Blobs[0])
+	ioutil.WriteFile(damaged, []byte("bit rot"), 0644)
+	missing, _, _ := r.findBlob(m.Files[1].Blobs[0])
+	os.Remove(missing)
+
+	result, err = r.Check(0)
+	if err != nil || result.OK() || len(result.Missing) != 1 || result.Read != 0 {
+		t.Errorf("check without reading should find the missing blob only: %v %v", result, err)
+	}
+	result, err = r.Check(100)
+	if err != nil || len(result.Missing) != 1 || len(result.Damaged) != 1 {
+		t.Errorf("check should find the damaged blob: %v %v", result, err)
+	}
+}
+
+func TestCheckRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, os.ModePerm)
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	ioutil.WriteFile(filepath.Join(src, "a.bin"), content, 0644)
+	r, err := Open(filepath.Join(dir, "repo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := r.Backup(context.Background(), "task", src, BackupOptions{ParityPercent: 10}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// damage a "sector" of the blob
+	path, _, _ := r.findBlob(m.Files[0].Blobs[0])
+	data, _ := ioutil.ReadFile(path)
+	for i := 4096; i < 4096+512; i++ {
+		data[i] ^= 0xff
+	}
+	ioutil.WriteFile(path, data, 0644)
+
+	result, err := r.Check(100)
+	if err != nil || !result.OK() || len(result.Repaired) != 1 {
+		t.Fatalf("damaged blob should be repaired: %v %v", result, err)
+	}
+	if repaired, _ := ioutil.ReadFile(path); !bytes.Equal(repaired, content) {
+		t.Error("blob repaired wrong")
+	}
+
+	// damage more than the parity can repair
+	data, _ = ioutil.ReadFile(path)
+	for i := 0; i < len(data); i += 1000 {
+		data[i] ^= 0xff
+	}
+	ioutil.WriteFile(path, data, 0644)
+	result, err = r.Check(100)
+	if err != nil || len(result.Damaged) != 1 {
+		t.Errorf("badly damaged blob should be reported: %v %v", result, err)
+	}
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"util"
+)
+
+// default chunk size bounds
+const (
+	DefaultChunkMinSize = 512 << 10
+	DefaultChunkAvgSize = 1 << 20
+	DefaultChunkMaxSize = 8 << 20
+)
+
+// Chunking is the chunk size bounds of a task, sizes are like 512K or 8M
+type Chunking struct {
+	MinSize string `yaml:"min_size"`
+	AvgSize string `yaml:"avg_size"`
+	MaxSize string `yaml:"max_size"`
+}
+
+// Sizes parses the bounds, the defaults are used for the empty ones
+func (c *Chunking) Sizes() (min, avg, max int, err error) {
+	min, avg, max = DefaultChunkMinSize, DefaultChunkAvgSize, DefaultChunkMaxSize
+	if c == nil {
+		return min, avg, max, nil
+	}
+	for _, s := range []struct {
+		value  string
+		result *int
+	}{{c.MinSize, &min}, {c.AvgSize, &avg}, {c.MaxSize, &max}} {
+		if s.value == "" {
+			continue
+		}
+		size, err := util.ParseSize(s.value)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		*s.result = int(size)
+	}
+	if min < 64 || min > avg || avg > max {
+		return 0, 0, 0, errors.New("chunk sizes should be 64 <= min_size <= avg_size <= max_size")
+	}
+	return min, avg, max, nil
+}
+
+// gear is the random table of the gear rolling hash, generated by splitmix64 so it never changes,
+// otherwise the chunk boundaries and the deduplication of existing data would change.
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x6261636b7570) // "backup"
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content defined chunks with a gear rolling hash.
+// A chunk ends where the top bits of the hash are zero, so an insertion or deletion only changes
+// the chunks around it and the rest of the file is deduplicated.
+type Chunker struct {
+	r        io.Reader
+	min, max int
+	mask     uint64
+	buf      []byte
+	// buf[start:end] is read but not returned yet
+	start, end int
+	eof        bool
+}
+
+func NewChunker(r io.Reader, min, avg, max int) *Chunker {
+	// about one position in avg is a boundary
+	n := uint(bits.Len(uint(avg)) - 1)
+	return &Chunker{
+		r:    r,
+		min:  min,
+		max:  max,
+		mask: ^uint64(0) << (64 - n),
+		buf:  make([]byte, max),
+	}
+}
+
+// Reset makes the chunker read from r, so the buffer can be reused for another file
+func (c *Chunker) Reset(r io.Reader) {
+	c.r = r
+	c.start, c.end = 0, 0
+	c.eof = false
+}
+
+// Next return the next chunk, or io.EOF at the end of the stream.
+// The chunk is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := len(data)
+	if len(data) > c.min {
+		var hash uint64
+		// the hash only depends on the last 64 bytes, so skipping the minimum size is safe
+		i := c.min - 64
+		if i < 0 {
+			i = 0
+		}
+		for ; i < len(data); i++ {
+			hash = (hash << 1) + gear[data[i]]
+			if i+1 >= c.min && hash&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+	c.start += cut
+	return data[:cut], nil
+}
+
+// fill makes sure the buffer holds max bytes or the rest of the stream
+func (c *Chunker) fill() error {
+	if c.end-c.start >= c.max || c.eof {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
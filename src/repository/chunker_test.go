@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunks(t *testing.T, data []byte, min, avg, max int) [][]byte {
+	c := NewChunker(bytes.NewReader(data), min, avg, max)
+	var result [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	min, avg, max := 16<<10, 64<<10, 256<<10
+
+	original := chunks(t, data, min, avg, max)
+	if !bytes.Equal(bytes.Join(original, nil), data) {
+		t.Fatal("chunks do not make up the data")
+	}
+	if len(original) < 16 || len(original) > 256 {
+		t.Errorf("unexpected chunk count %d for average size %d", len(original), avg)
+	}
+	for i, chunk := range original {
+		if len(chunk) > max || (len(chunk) < min && i != len(original)-1) {
+			t.Errorf("chunk %d size %d out of bounds", i, len(chunk))
+		}
+	}
+
+	// insert some bytes in the middle, most chunks should stay the same
+	changed := append(append(append([]byte(nil), data[:2<<20]...), []byte("inserted")...), data[2<<20:]...)
+	known := make(map[string]bool)
+	for _, chunk := range original {
+		known[string(chunk)] = true
+	}
+	same := 0
+	after := chunks(t, changed, min, avg, max)
+	for _, chunk := range after {
+		if known[string(chunk)] {
+			same++
+		}
+	}
+	if same < len(after)-3 {
+		t.Errorf("only %d of %d chunks unchanged after an insertion", same, len(after))
+	}
+}
+
+func TestChunkingSizes(t *testing.T) {
+	min, avg, max, err := (&Chunking{MinSize: "256K", MaxSize: "4M"}).Sizes()
+	if err != nil || min != 256<<10 || avg != DefaultChunkAvgSize || max != 4<<20 {
+		t.Errorf("unexpected sizes %d %d %d %v", min, avg, max, err)
+	}
+	if _, _, _, err = (&Chunking{MinSize: "2M", AvgSize: "1M"}).Sizes(); err == nil {
+		t.Error("min size larger than avg size should fail")
+	}
+}
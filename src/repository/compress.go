@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// the suffix of stored blob files, blobs are stored raw if compression does not help
+const (
+	rawSuffix  = ""
+	gzipSuffix = ".gz"
+	zstdSuffix = ".zst"
+)
+
+var blobSuffixes = []string{rawSuffix, zstdSuffix, gzipSuffix}
+
+// suffixCode is the code of the compression in encrypted blobs
+func suffixCode(suffix string) byte {
+	for i, s := range blobSuffixes {
+		if s == suffix {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+func codeSuffix(code byte) string {
+	if int(code) < len(blobSuffixes) {
+		return blobSuffixes[code]
+	}
+	return "unknown"
+}
+
+// data with more bits of entropy per byte is considered already compressed
+const maxEntropy = 7.5
+
+// the size of the sample for the entropy probe
+const entropySampleSize = 64 << 10
+
+// extensions of formats that are already compressed
+var compressedExtensions = map[string]bool{
+	".7z": true, ".avi": true, ".bz2": true, ".cab": true, ".docx": true, ".flac": true, ".gif": true, ".gz": true,
+	".heic": true, ".jpeg": true, ".jpg": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".ogg": true,
+	".png": true, ".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true, ".xlsx": true, ".xz": true,
+	".zip": true, ".zst": true,
+}
+
+// Compression is the compression of stored data of a task
+type Compression struct {
+	// none, gzip or zstd
+	Algorithm string `yaml:"algorithm"`
+	// gzip levels are 1 ~ 9, zstd levels are 1 ~ 22, 0 means the default level
+	Level int `yaml:"level"`
+}
+
+func (c *Compression) Validate() error {
+	if c == nil {
+		return nil
+	}
+	switch strings.ToLower(c.Algorithm) {
+	case "", CompressionNone:
+	case CompressionGzip:
+		if c.Level < 0 || c.Level > gzip.BestCompression {
+			return errors.New("gzip level should be 1 ~ 9")
+		}
+	case CompressionZstd:
+		if c.Level < 0 || c.Level > 22 {
+			return errors.New("zstd level should be 1 ~ 22")
+		}
+	default:
+		return errors.New("unknown compression " + c.Algorithm)
+	}
+	return nil
+}
+
+// Enabled report whether the data is compressed
+func (c *Compression) Enabled() bool {
+	return c != nil && c.Algorithm != "" && !strings.EqualFold(c.Algorithm, CompressionNone)
+}
+
+// compressor compresses the chunks of a backup
+type compressor struct {
+	algorithm string
+	level     int
+	zstd      *zstd.Encoder
+}
+
+// newCompressor return nil if the data should not be compressed
+func newCompressor(c *Compression) (*compressor, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if !c.Enabled() {
+		return nil, nil
+	}
+	comp := &compressor{algorithm: strings.ToLower(c.Algorithm), level: c.Level}
+	switch comp.algorithm {
+	case CompressionGzip:
+		if comp.level == 0 {
+			comp.level = gzip.DefaultCompression
+		}
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if c.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		comp.zstd = encoder
+	}
+	return comp, nil
+}
+
+// compress return the data to store and the suffix of the blob file,
+// the data is returned as it is if compression does not make it smaller
+func (c *compressor) compress(data []byte) ([]byte, string, error) {
+	var compressed []byte
+	var suffix string
+	switch c.algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, c.level)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err = w.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err = w.Close(); err != nil {
+			return nil, "", err
+		}
+		compressed, suffix = buf.Bytes(), gzipSuffix
+	case CompressionZstd:
+		compressed, suffix = c.zstd.EncodeAll(data, make([]byte, 0, len(data)/2)), zstdSuffix
+	}
+	if len(compressed) >= len(data) {
+		return data, rawSuffix, nil
+	}
+	return compressed, suffix, nil
+}
+
+func (c *compressor) close() {
+	if c != nil && c.zstd != nil {
+		c.zstd.Close()
+	}
+}
+
+var (
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderOnce sync.Once
+	zstdDecoderErr  error
+)
+
+// decompress decodes the content of a blob file with the suffix
+func decompress(data []byte, suffix string) ([]byte, error) {
+	switch suffix {
+	case rawSuffix:
+		return data, nil
+	case gzipSuffix:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case zstdSuffix:
+		zstdDecoderOnce.Do(func() {
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil)
+		})
+		if zstdDecoderErr != nil {
+			return nil, zstdDecoderErr
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, errors.New("unknown blob suffix " + suffix)
+}
+
+// isCompressed guesses whether a file is already compressed by its extension,
+// or by the entropy of a sample of its content
+func isCompressed(name string, sample []byte) bool {
+	if compressedExtensions[strings.ToLower(filepath.Ext(name))] {
+		return true
+	}
+	if len(sample) > entropySampleSize {
+		sample = sample[:entropySampleSize]
+	}
+	return entropy(sample) > maxEntropy
+}
+
+// entropy return the Shannon entropy of data in bits per byte
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var e float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(data))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"restore"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsCompressed(t *testing.T) {
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat("backup is a util app to backup your files. ", 200))
+	if !isCompressed("a.bin", random) {
+		t.Error("random data should be considered compressed")
+	}
+	if isCompressed("a.txt", text) {
+		t.Error("text should not be considered compressed")
+	}
+	if !isCompressed("a.ZIP", text) {
+		t.Error("zip file should be considered compressed")
+	}
+}
+
+func TestCompressedBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, os.ModePerm)
+	text := []byte(strings.Repeat("backup is a util app to backup your files. ", 20000))
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), text, 0644)
+	ioutil.WriteFile(filepath.Join(src, "b.bin"), random, 0644)
+
+	for i, algorithm := range []string{CompressionGzip, CompressionZstd} {
+		r, err := Open(filepath.Join(dir, "repo-"+algorithm), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := BackupOptions{Compression: &Compression{Algorithm: algorithm, Level: 3}}
+		m, stats, err := r.Backup(context.Background(), "task", src, opts, time.Now().Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.CompressionRatio() < 1.5 {
+			t.Errorf("%s: unexpected compression ratio %v", algorithm, stats.CompressionRatio())
+		}
+		target := filepath.Join(dir, "target-"+algorithm)
+		if _, err = restore.Restore(r.Source(m), restore.Options{Target: target}); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(target, "a.txt")); !bytes.Equal(b, text) {
+			t.Errorf("%s: a.txt restored wrong", algorithm)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(target, "b.bin")); !bytes.Equal(b, random) {
+			t.Errorf("%s: b.bin restored wrong", algorithm)
+		}
+	}
+}
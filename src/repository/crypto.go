@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"values"
+)
+
+const configFileName = "config.json"
+
+// scrypt parameters of new repositories, about 32MB memory
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// the plain text sealed in the config to check the passphrase
+const checkText = "backup repository key"
+
+// repoConfig is saved in config.json of the repository
+type repoConfig struct {
+	Version    int               `json:"version"`
+	Encryption *encryptionConfig `json:"encryption,omitempty"`
+}
+
+type encryptionConfig struct {
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	// checkText sealed with the key
+	Check []byte `json:"check"`
+}
+
+// keys of an encrypted repository
+type keys struct {
+	// AES-256-GCM for blobs and manifests
+	aead cipher.AEAD
+	// HMAC-SHA256 key for blob ids and task directory names, so they do not reveal the content
+	mac []byte
+}
+
+func deriveKeys(passphrase []byte, c *encryptionConfig) (*keys, error) {
+	if c.KDF != "scrypt" {
+		return nil, errors.New("unknown kdf " + c.KDF)
+	}
+	key, err := scrypt.Key(passphrase, c.Salt, c.N, c.R, c.P, 64)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &keys{aead: aead, mac: key[32:]}, nil
+}
+
+// seal encrypts data, the result is nonce + cipher text, aad binds it to its name
+func (k *keys) seal(data, aad []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(data)+k.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, data, aad), nil
+}
+
+func (k *keys) open(data, aad []byte) ([]byte, error) {
+	if len(data) < k.aead.NonceSize() {
+		return nil, errors.New("data is damaged or tampered")
+	}
+	plain, err := k.aead.Open(nil, data[:k.aead.NonceSize()], data[k.aead.NonceSize():], aad)
+	if err != nil {
+		return nil, errors.New("data is damaged or tampered")
+	}
+	return plain, nil
+}
+
+func (k *keys) sum(data []byte) string {
+	h := hmac.New(sha256.New, k.mac)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newHash return the hash of blob ids
+func (r *Repository) newHash() hash.Hash {
+	if r.keys != nil {
+		return hmac.New(sha256.New, r.keys.mac)
+	}
+	return sha256.New()
+}
+
+// loadConfig reads config.json, nil is returned for repositories created before it existed
+func loadConfig(root string) (*repoConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, configFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var c repoConfig
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, errors.New("invalid repository config: " + err.Error())
+	}
+	return &c, nil
+}
+
+func saveConfig(root string, c *repoConfig) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(root, configFileName)
+	tmp := path + values.TempFileSuffix
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// initConfig creates the config of a new repository, it is encrypted if passphrase is not empty
+func initConfig(root string, passphrase []byte) (*repoConfig, *keys, error) {
+	c := &repoConfig{Version: 1}
+	var k *keys
+	if len(passphrase) > 0 {
+		c.Encryption = &encryptionConfig{KDF: "scrypt", Salt: make([]byte, 32), N: scryptN, R: scryptR, P: scryptP}
+		if _, err := io.ReadFull(rand.Reader, c.Encryption.Salt); err != nil {
+			return nil, nil, err
+		}
+		var err error
+		if k, err = deriveKeys(passphrase, c.Encryption); err != nil {
+			return nil, nil, err
+		}
+		if c.Encryption.Check, err = k.seal([]byte(checkText), []byte(configFileName)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, k, saveConfig(root, c)
+}
+
+// ReadKeyFile reads the passphrase in the key file, surrounding spaces and line breaks are ignored
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := bytes.TrimSpace(data)
+	if len(passphrase) == 0 {
+		return nil, errors.New("key file " + path + " is empty")
+	}
+	return passphrase, nil
+}
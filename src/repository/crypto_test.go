@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"restore"
+	"snapshot"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(src, "secret-name.txt"), []byte("secret content"), 0644)
+	root := filepath.Join(dir, "repo")
+	passphrase := []byte("correct horse battery staple")
+
+	r, err := Open(root, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := r.Backup(context.Background(), "my-task", src, BackupOptions{Compression: &Compression{Algorithm: CompressionZstd}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || strings.Contains(path, "my-task") || strings.Contains(path, "secret") {
+			t.Errorf("%s reveals the task or file name", path)
+		}
+		if info.Mode().IsRegular() {
+			data, _ := ioutil.ReadFile(path)
+			if bytes.Contains(data, []byte("secret")) {
+				t.Errorf("%s is not encrypted", path)
+			}
+		}
+		return nil
+	})
+
+	if _, err = Open(root, []byte("wrong")); err == nil {
+		t.Error("open with a wrong passphrase should fail")
+	}
+	if _, err = Open(root, nil); err == nil {
+		t.Error("open an encrypted repository without passphrase should fail")
+	}
+
+	r, err = Open(root, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := r.Snapshots("my-task")
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("snapshots: %v %v", snapshots, err)
+	}
+	if m, err = r.LoadManifest(snapshots[0]); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "target")
+	if _, err = restore.Restore(r.Source(m), restore.Options{Target: target}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(target, "secret-name.txt")); string(b) != "secret content" {
+		t.Errorf("restored wrong content %s", b)
+	}
+
+	// a manifest copied to another time or task is refused
+	r.Backup(context.Background(), "other-task", src, BackupOptions{}, time.Now())
+	data, _ := ioutil.ReadFile(snapshots[0].Path)
+	moved := snapshot.Snapshot{Name: "2000-01-02_030405", Path: filepath.Join(filepath.Dir(snapshots[0].Path), "2000-01-02_030405.json")}
+	ioutil.WriteFile(moved.Path, data, 0644)
+	if _, err = r.LoadManifest(moved); err == nil {
+		t.Error("manifest renamed to another time should be refused")
+	}
+	os.Remove(moved.Path)
+	others, err := r.Snapshots("other-task")
+	if err != nil || len(others) != 1 {
+		t.Fatalf("snapshots of other task: %v %v", others, err)
+	}
+	ioutil.WriteFile(others[0].Path, data, 0644)
+	if _, err = r.LoadManifest(others[0]); err == nil {
+		t.Error("manifest copied to another task should be refused")
+	}
+
+	// flip a byte of the blob
+	path, _, _ := r.findBlob(m.Files[0].Blobs[0])
+	data, _ = ioutil.ReadFile(path)
+	data[len(data)-1] ^= 1
+	ioutil.WriteFile(path, data, 0644)
+	os.RemoveAll(target)
+	if _, err = restore.Restore(r.Source(m), restore.Options{Target: target}); err == nil {
+		t.Error("restore of tampered data should fail")
+	}
+	if _, err = os.Stat(filepath.Join(target, "secret-name.txt")); !os.IsNotExist(err) {
+		t.Error("tampered file should not be restored")
+	}
+}
@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"glog"
+	"io/ioutil"
+	"os"
+	"parity"
+	"values"
+)
+
+// the parity of a blob file is stored beside it in <blob file>.par:
+//   magic, data shard count, parity shard count, shard size, blob file length (uint32, uint32, uint64, uint64),
+//   SHA-256 of every data and parity shard, SHA-256 of all above, parity shards
+// The shard hashes tell which shards are damaged, Reed-Solomon rebuilds them from the others.
+const paritySuffix = ".par"
+
+var parityMagic = []byte("BKPAR\x00\x00\x01")
+
+// a blob file is split into at most maxDataShards shards of at least minShardSize
+const (
+	maxDataShards = 20
+	minShardSize  = 64
+)
+
+func parityPath(blobFile string) string {
+	return blobFile + paritySuffix
+}
+
+// shardCounts return the data and parity shard count of a blob file with percent redundancy
+func shardCounts(length, percent int) (int, int) {
+	data := (length + minShardSize - 1) / minShardSize
+	if data > maxDataShards {
+		data = maxDataShards
+	}
+	if data == 0 {
+		data = 1
+	}
+	p := (data*percent + 99) / 100
+	if p == 0 {
+		p = 1
+	}
+	return data, p
+}
+
+// writeParity writes the parity of the blob file with content data
+func writeParity(blobFile string, data []byte, percent int) error {
+	dataShards, parityShards := shardCounts(len(data), percent)
+	enc, err := parity.New(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	shards := enc.Split(data)
+	if err = enc.Encode(shards); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(parityMagic)
+	binary.Write(&buf, binary.LittleEndian, uint32(dataShards))
+	binary.Write(&buf, binary.LittleEndian, uint32(parityShards))
+	binary.Write(&buf, binary.LittleEndian, uint64(len(shards[0])))
+	binary.Write(&buf, binary.LittleEndian, uint64(len(data)))
+	for _, shard := range shards {
+		sum := sha256.Sum256(shard)
+		buf.Write(sum[:])
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	for _, shard := range shards[dataShards:] {
+		buf.Write(shard)
+	}
+
+	path := parityPath(blobFile)
+	tmp := path + values.TempFileSuffix
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ensureParity writes the parity of an existing blob file if it has none
+func ensureParity(blobFile string, percent int) error {
+	if _, err := os.Stat(parityPath(blobFile)); err == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(blobFile)
+	if err != nil {
+		return err
+	}
+	return writeParity(blobFile, data, percent)
+}
+
+// repairBlob rebuilds the damaged shards of a blob file from its parity
+func (r *Repository) repairBlob(id string) error {
+	blobFile, _, ok := r.findBlob(id)
+	if !ok {
+		return errors.New("blob " + id + " is missing, it can not be repaired")
+	}
+	par, err := ioutil.ReadFile(parityPath(blobFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("blob " + id + " has no parity")
+		}
+		return err
+	}
+
+	headerSize := len(parityMagic) + 24
+	if len(par) < headerSize || !bytes.Equal(par[:len(parityMagic)], parityMagic) {
+		return errors.New("parity of blob " + id + " is damaged")
+	}
+	dataShards := int(binary.LittleEndian.Uint32(par[len(parityMagic):]))
+	parityShards := int(binary.LittleEndian.Uint32(par[len(parityMagic)+4:]))
+	shardSize := int(binary.LittleEndian.Uint64(par[len(parityMagic)+8:]))
+	length := int(binary.LittleEndian.Uint64(par[len(parityMagic)+16:]))
+	total := dataShards + parityShards
+	hashesEnd := headerSize + total*sha256.Size
+	if dataShards <= 0 || parityShards <= 0 || total > 256 || shardSize <= 0 ||
+		len(par) != hashesEnd+sha256.Size+parityShards*shardSize {
+		return errors.New("parity of blob " + id + " is damaged")
+	}
+	if sum := sha256.Sum256(par[:hashesEnd]); !bytes.Equal(sum[:], par[hashesEnd:hashesEnd+sha256.Size]) {
+		return errors.New("parity of blob " + id + " is damaged")
+	}
+
+	data, err := ioutil.ReadFile(blobFile)
+	if err != nil {
+		return err
+	}
+	shards := make([][]byte, total)
+	lost := 0
+	for i := range shards {
+		shard := make([]byte, shardSize)
+		if i < dataShards {
+			if i*shardSize < len(data) {
+				copy(shard, data[i*shardSize:])
+			}
+		} else {
+			start := hashesEnd + sha256.Size + (i-dataShards)*shardSize
+			copy(shard, par[start:start+shardSize])
+		}
+		sum := sha256.Sum256(shard)
+		if bytes.Equal(sum[:], par[headerSize+i*sha256.Size:headerSize+(i+1)*sha256.Size]) {
+			shards[i] = shard
+		} else {
+			lost++
+		}
+	}
+	if lost == 0 && len(data) == length {
+		return errors.New("blob " + id + " is damaged but all shards match its parity")
+	}
+	enc, err := parity.New(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	if err = enc.Reconstruct(shards); err != nil {
+		return errors.New("repair blob " + id + " failed: " + err.Error())
+	}
+	repaired := bytes.Join(shards[:dataShards], nil)[:length]
+
+	tmp := blobFile + values.TempFileSuffix
+	if err = ioutil.WriteFile(tmp, repaired, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, blobFile); err != nil {
+		return err
+	}
+	if err = r.readBlob(id); err != nil {
+		return errors.New("blob " + id + " is still damaged after repair: " + err.Error())
+	}
+	glog.Warningf("blob %s repaired, %d of %d shards were damaged", id, lost, total)
+	return nil
+}
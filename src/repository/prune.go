@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"snapshot"
+	"strings"
+	"time"
+	"values"
+)
+
+// Forget removes the manifest of a snapshot, the blobs are removed by GC later
+func (r *Repository) Forget(s snapshot.Snapshot) error {
+	return os.Remove(s.Path)
+}
+
+// Prune forgets the snapshots of the task not kept by the retention and collects the blobs no longer used,
+// it return the pruned (or would be pruned in dry run) snapshots.
+func (r *Repository) Prune(task string, retention *snapshot.Retention, now time.Time) ([]snapshot.Snapshot, error) {
+	all, err := r.Snapshots(task)
+	if err != nil {
+		return nil, err
+	}
+	// the directory may be shared with a task of another name, see SameTaskDir
+	var snapshots []snapshot.Snapshot
+	for _, s := range all {
+		m, err := r.LoadManifest(s)
+		if err != nil {
+			glog.Warningf("snapshot %s of task %s is not pruned: %v", s.Name, task, err)
+			continue
+		}
+		if m.Task == task {
+			snapshots = append(snapshots, s)
+		}
+	}
+	_, prune := retention.Apply(snapshots, now)
+	if len(prune) == 0 {
+		return nil, nil
+	}
+	for _, s := range prune {
+		if retention.DryRun {
+			glog.Infof("dry run: would prune snapshot %s of task %s", s.Name, task)
+			continue
+		}
+		glog.Infof("prune snapshot %s of task %s", s.Name, task)
+		if err = r.Forget(s); err != nil {
+			return prune, err
+		}
+	}
+	if retention.DryRun {
+		return prune, nil
+	}
+	removed, freed, err := r.GC()
+	if err == nil {
+		glog.Infof("repository %s removed %d unused blobs, %d bytes freed", r.Root, removed, freed)
+	}
+	return prune, err
+}
+
+// GC removes the blobs which are not used by any snapshot of any task
+func (r *Repository) GC() (removed int, freed int64, err error) {
+	lock := lockOf(r.Root)
+	lock.Lock()
+	defer lock.Unlock()
+
+	used, err := r.usedBlobs()
+	if err != nil {
+		return 0, 0, err
+	}
+	err = r.walkBlobs(func(id, path string, info os.FileInfo) error {
+		if used[id] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		os.Remove(parityPath(path))
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+// usedBlobs return the blobs used by all snapshots in the repository
+func (r *Repository) usedBlobs() (map[string]bool, error) {
+	snapshots, err := r.allManifests()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, s := range snapshots {
+		m, err := r.LoadManifest(s)
+		if err != nil {
+			// never collect blobs while a manifest can not be read, they may be used by it
+			return nil, err
+		}
+		for _, n := range m.Files {
+			for _, id := range n.Blobs {
+				used[id] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// walkBlobs calls fn for every stored blob, temporary files of interrupted writes in the blobs directory are removed
+func (r *Repository) walkBlobs(fn func(id, path string, info os.FileInfo) error) error {
+	blobsDir := filepath.Join(r.Root, "blobs")
+	dirs, err := ioutil.ReadDir(blobsDir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			if strings.Contains(dir.Name(), values.TempFileSuffix) {
+				os.Remove(filepath.Join(blobsDir, dir.Name()))
+			}
+			continue
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(blobsDir, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), paritySuffix) || strings.Contains(info.Name(), values.TempFileSuffix) {
+				continue
+			}
+			// the name is the id with the suffix of the compression
+			id := strings.SplitN(info.Name(), ".", 2)[0]
+			if err = fn(id, filepath.Join(blobsDir, dir.Name(), info.Name()), info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
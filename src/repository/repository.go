@@ -0,0 +1,626 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"copier"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"glog"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"snapshot"
+	"strings"
+	"sync"
+	"time"
+	"util"
+	"values"
+)
+
+// A repository stores file contents as blobs named by their SHA-256, and one manifest per snapshot:
+//   <root>/config.json
+//   <root>/blobs/<first 2 hex>/<sha256 hex>
+//   <root>/snapshots/<task>/<time>.json
+// Identical content of all tasks and runs backed up to the same repository is stored once.
+// In an encrypted repository blobs and manifests are sealed with AES-256-GCM, blob ids and task
+// directories are named by HMAC-SHA256 instead, so neither content nor file names can be read without the key.
+type Repository struct {
+	Root string
+	// nil if the repository is not encrypted
+	keys *keys
+}
+
+// backups hold the read lock of the repository, garbage collection holds the write lock,
+// so blobs written by a running backup are never collected before its manifest is saved.
+var (
+	locksMutex sync.Mutex
+	locks      = make(map[string]*sync.RWMutex)
+)
+
+func lockOf(root string) *sync.RWMutex {
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+	l, ok := locks[root]
+	if !ok {
+		l = &sync.RWMutex{}
+		locks[root] = l
+	}
+	return l
+}
+
+// Open opens the repository at root, it is created if not exist.
+// passphrase is required for encrypted repositories, a new repository is encrypted if it is given.
+func Open(root string, passphrase []byte) (*Repository, error) {
+	root = filepath.Clean(root)
+	for _, dir := range []string{"blobs", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	r := &Repository{Root: root}
+	c, err := loadConfig(root)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		if len(passphrase) > 0 && !r.isEmpty() {
+			return nil, errors.New("repository " + root + " already has unencrypted data, use another dst for encrypted tasks")
+		}
+		if c, r.keys, err = initConfig(root, passphrase); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	if c.Encryption == nil {
+		if len(passphrase) > 0 {
+			return nil, errors.New("repository " + root + " is not encrypted, use another dst for encrypted tasks")
+		}
+		return r, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("repository " + root + " is encrypted, the key file is required")
+	}
+	if r.keys, err = deriveKeys(passphrase, c.Encryption); err != nil {
+		return nil, err
+	}
+	if check, err := r.keys.open(c.Encryption.Check, []byte(configFileName)); err != nil || string(check) != checkText {
+		return nil, errors.New("wrong key of repository " + root)
+	}
+	return r, nil
+}
+
+// Encrypted report whether the repository is encrypted
+func (r *Repository) Encrypted() bool {
+	return r.keys != nil
+}
+
+func (r *Repository) isEmpty() bool {
+	for _, dir := range []string{"blobs", "snapshots"} {
+		if infos, err := ioutil.ReadDir(filepath.Join(r.Root, dir)); err != nil || len(infos) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Node is a file in a snapshot
+type Node struct {
+	// path relative to the backup root, separated by /
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	// the content of the file is the concatenation of the blobs
+	Blobs []string `json:"blobs"`
+}
+
+// Manifest describes a snapshot of a task
+type Manifest struct {
+	Task  string    `json:"task"`
+	Src   string    `json:"src"`
+	Time  time.Time `json:"time"`
+	Files []Node    `json:"files"`
+}
+
+// Stats is the result of a backup
+type Stats struct {
+	Files int
+	// files unchanged since the previous snapshot, which are not read again
+	Unchanged int
+	Bytes     int64
+	// blobs that were not in the repository
+	NewBlobs    int
+	StoredBytes int64
+	// the size of new blobs after compression
+	WrittenBytes int64
+	Failed      int
+	Errors      []string
+	// blobs verified and the files with mismatched blobs, when BackupOptions.Verify is set
+	Verified   int
+	Mismatched []string
+}
+
+// CompressionRatio is the ratio of the original size to the compressed size of the new blobs
+func (s *Stats) CompressionRatio() float64 {
+	if s.WrittenBytes == 0 {
+		return 1
+	}
+	return float64(s.StoredBytes) / float64(s.WrittenBytes)
+}
+
+func (r *Repository) blobPath(id, suffix string) string {
+	return filepath.Join(r.Root, "blobs", id[:2], id+suffix)
+}
+
+func (r *Repository) taskDir(task string) string {
+	if r.keys != nil {
+		return filepath.Join(r.Root, "snapshots", r.keys.sum([]byte("task:" + task))[:32])
+	}
+	return filepath.Join(r.Root, "snapshots", safeName(task))
+}
+
+// SameTaskDir report whether the tasks of names a and b may share their snapshot directory in a repository,
+// as their names are the same once made usable as directory names, regardless of case
+func SameTaskDir(a, b string) bool {
+	return strings.EqualFold(safeName(a), safeName(b))
+}
+
+// safeName makes the task name usable as a directory name, distinct names like a/b and a_b may be the same
+func safeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			r > 127 {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// findBlob return the path and suffix of the stored blob
+func (r *Repository) findBlob(id string) (path, suffix string, ok bool) {
+	for _, suffix = range blobSuffixes {
+		path = r.blobPath(id, suffix)
+		if _, err := os.Stat(path); err == nil {
+			return path, suffix, true
+		}
+	}
+	return "", "", false
+}
+
+// HasBlob report whether the blob is stored
+func (r *Repository) HasBlob(id string) bool {
+	_, _, ok := r.findBlob(id)
+	return ok
+}
+
+// OpenBlob opens a stored blob for reading its original content.
+// The content is checked against the id, damaged or tampered blobs return an error.
+func (r *Repository) OpenBlob(id string) (io.ReadCloser, error) {
+	path, suffix, ok := r.findBlob(id)
+	if !ok {
+		return nil, errors.New("blob " + id + " not found")
+	}
+	if suffix == rawSuffix && r.keys == nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &verifyReader{ReadCloser: f, hash: r.newHash(), id: id}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if r.keys != nil {
+		if data, err = r.keys.open(data, []byte(id)); err != nil || len(data) == 0 {
+			return nil, errors.New("blob " + id + " is damaged or tampered")
+		}
+		suffix, data = codeSuffix(data[0]), data[1:]
+	}
+	if data, err = decompress(data, suffix); err != nil {
+		return nil, errors.New("decompress blob " + id + " failed: " + err.Error())
+	}
+	if r.blobID(data) != id {
+		return nil, errors.New("blob " + id + " is damaged or tampered")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (r *Repository) blobID(data []byte) string {
+	h := r.newHash()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyReader checks the hash of the content when it reaches the end
+type verifyReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	id   string
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.id {
+		return n, errors.New("blob " + v.id + " is damaged or tampered")
+	}
+	return n, err
+}
+
+// putBlob stores data, compressed if comp is not nil, and return its id,
+// and the size written if it is new to the repository.
+// Parity with parityPercent redundancy is written for the blob file if parityPercent is positive.
+func (r *Repository) putBlob(data []byte, comp *compressor, parityPercent int) (id string, written int64, err error) {
+	id = r.blobID(data)
+	if path, _, ok := r.findBlob(id); ok {
+		if parityPercent > 0 {
+			err = ensureParity(path, parityPercent)
+		}
+		return id, 0, err
+	}
+	suffix := rawSuffix
+	if comp != nil {
+		if data, suffix, err = comp.compress(data); err != nil {
+			return "", 0, err
+		}
+	}
+	if r.keys != nil {
+		// the compression is sealed with the data, the file name does not reveal it
+		payload := append([]byte{suffixCode(suffix)}, data...)
+		if data, err = r.keys.seal(payload, []byte(id)); err != nil {
+			return "", 0, err
+		}
+		suffix = rawSuffix
+	}
+	path := r.blobPath(id, suffix)
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(r.Root, "blobs"), "blob"+values.TempFileSuffix)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	if parityPercent > 0 {
+		if err = writeParity(path, data, parityPercent); err != nil {
+			return "", 0, err
+		}
+	}
+	return id, int64(len(data)), nil
+}
+
+// BackupOptions are the settings of a task for the repository
+type BackupOptions struct {
+	FilteredFiles []string
+	Chunking      *Chunking
+	Compression   *Compression
+	// re-read the new blobs after writing them and check them against their ids
+	Verify bool
+	// the redundancy percentage of the parity written for blobs, 0 means no parity
+	ParityPercent int
+	// if set, called before each file is stored, it may block to pause the backup or return an error to abort it
+	Wait func() error
+	// if set, called after each file is stored or failed, with its path relative to src and its size
+	Progress func(path string, size int64)
+}
+
+// Backup stores src (a file or directory) as a new snapshot of the task.
+// Files with the same size and modification time as in the previous snapshot are not read again.
+// The backup stops with the error of ctx once ctx is done, no snapshot is saved then.
+func (r *Repository) Backup(ctx context.Context, task, src string, opts BackupOptions, now time.Time) (*Manifest, *Stats, error) {
+	lock := lockOf(r.Root)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	chunkMin, chunkAvg, chunkMax, err := opts.Chunking.Sizes()
+	if err != nil {
+		return nil, nil, err
+	}
+	filtered := opts.FilteredFiles
+	comp, err := newCompressor(opts.Compression)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer comp.close()
+	// one chunker for all files, to reuse its buffer
+	chunker := NewChunker(nil, chunkMin, chunkAvg, chunkMax)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous := make(map[string]Node)
+	if latest, err := r.latest(task); err != nil {
+		glog.Warningf("load the latest snapshot of task %s failed, all files will be read: %v", task, err)
+	} else if latest != nil {
+		for _, n := range latest.Files {
+			previous[n.Path] = n
+		}
+	}
+
+	manifest := &Manifest{Task: task, Src: src, Time: now}
+	stats := &Stats{}
+	add := func(path, rel string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if opts.Wait != nil {
+			if err := opts.Wait(); err != nil {
+				return err
+			}
+		}
+		node := Node{Path: rel, Size: info.Size(), Mode: info.Mode(), ModTime: info.ModTime()}
+		if opts.Progress != nil {
+			defer opts.Progress(rel, node.Size)
+		}
+		if prev, ok := previous[rel]; ok && prev.Size == node.Size && prev.ModTime.Equal(node.ModTime) && r.hasBlobs(prev.Blobs) {
+			node.Blobs = prev.Blobs
+			stats.Unchanged++
+		} else if err := r.storeFile(ctx, path, &node, chunker, comp, opts, stats); err == errMismatch {
+			stats.Mismatched = append(stats.Mismatched, rel)
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			glog.Errorf("backup %s failed: %v", path, err)
+			stats.Failed++
+			stats.Errors = append(stats.Errors, rel+": "+err.Error())
+			return nil
+		}
+		stats.Files++
+		stats.Bytes += node.Size
+		manifest.Files = append(manifest.Files, node)
+		return nil
+	}
+
+	if fi.Mode().IsRegular() {
+		if !copier.IsFiltered(fi.Name(), filtered) {
+			if err = add(src, fi.Name(), fi); err != nil {
+				return nil, stats, err
+			}
+		}
+	} else if fi.IsDir() {
+		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			rel, relErr := filepath.Rel(src, path)
+			if relErr != nil {
+				return relErr
+			}
+			if err != nil {
+				stats.Failed++
+				stats.Errors = append(stats.Errors, rel+": "+err.Error())
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() || copier.IsFiltered(info.Name(), filtered) {
+				return nil
+			}
+			return add(path, filepath.ToSlash(rel), info)
+		})
+		if err != nil {
+			return nil, stats, err
+		}
+	} else {
+		return nil, stats, errors.New(src + " is neither a file nor a directory.")
+	}
+
+	if stats.Failed > 0 {
+		// a snapshot missing files is not saved, the next run will try again
+		return nil, stats, fmt.Errorf("%d files failed to backup", stats.Failed)
+	}
+	if len(stats.Mismatched) > 0 {
+		return nil, stats, copier.MismatchError(stats.Mismatched)
+	}
+	if err = r.saveManifest(manifest); err != nil {
+		return nil, stats, err
+	}
+	return manifest, stats, nil
+}
+
+func (r *Repository) hasBlobs(ids []string) bool {
+	for _, id := range ids {
+		if !r.HasBlob(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// storeFile stores the content of the file chunk by chunk and fills node.Blobs,
+// the file is not compressed if it looks already compressed
+func (r *Repository) storeFile(ctx context.Context, path string, node *Node, chunker *Chunker, comp *compressor,
+	opts BackupOptions, stats *Stats) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chunker.Reset(&util.ContextReader{Ctx: ctx, Reader: f})
+	node.Blobs = nil
+	for first := true; ; first = false {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if first && comp != nil && isCompressed(path, chunk) {
+			comp = nil
+		}
+		id, written, err := r.putBlob(chunk, comp, opts.ParityPercent)
+		if err != nil {
+			return err
+		}
+		node.Blobs = append(node.Blobs, id)
+		if written > 0 {
+			stats.NewBlobs++
+			stats.StoredBytes += int64(len(chunk))
+			stats.WrittenBytes += written
+			if opts.Verify {
+				stats.Verified++
+				if err = r.verifyBlob(id); err != nil {
+					glog.Errorf("verify %s failed: %v", path, err)
+					return errMismatch
+				}
+			}
+		}
+	}
+}
+
+var errMismatch = errors.New("mismatched after write")
+
+// verifyBlob reads the blob back and checks it against its id, a bad blob is removed
+func (r *Repository) verifyBlob(id string) error {
+	err := r.readBlob(id)
+	if err != nil {
+		if path, _, ok := r.findBlob(id); ok {
+			os.Remove(path)
+			os.Remove(parityPath(path))
+		}
+	}
+	return err
+}
+
+func (r *Repository) saveManifest(m *Manifest) error {
+	dir := r.taskDir(m.Task)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	name := snapshot.UniqueName(m.Time, func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name+".json"))
+		return err == nil
+	})
+	if r.keys != nil {
+		if data, err = r.keys.seal(data, manifestAAD(dir, name)); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(dir, name+".json")
+	tmp := path + values.TempFileSuffix
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// manifestAAD is the additional data a manifest is sealed with, which binds it to its task directory and
+// snapshot name, so a manifest copied or renamed to another task or time can not be opened
+func manifestAAD(dir, name string) []byte {
+	return []byte("manifest:" + filepath.Base(dir) + "/" + name)
+}
+
+// LoadManifest loads the manifest of a snapshot listed by Snapshots.
+// A manifest not of the task and time of its path, like one copied from another snapshot, is refused.
+func (r *Repository) LoadManifest(s snapshot.Snapshot) (*Manifest, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(s.Path)
+	if r.keys != nil {
+		if data, err = r.keys.open(data, manifestAAD(dir, s.Name)); err != nil {
+			return nil, errors.New("manifest " + s.Path + " is damaged or tampered")
+		}
+	}
+	var m Manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, errors.New("invalid manifest " + s.Path + ": " + err.Error())
+	}
+	if r.taskDir(m.Task) != dir || !snapshot.Matches(s.Name, m.Time) {
+		return nil, errors.New("manifest " + s.Path + " is of task " + m.Task + " at " +
+			m.Time.Format(snapshot.TimeFormat) + ", it was moved or tampered")
+	}
+	return &m, nil
+}
+
+// Snapshots return the snapshots of the task, oldest first, the Path of a snapshot is its manifest
+func (r *Repository) Snapshots(task string) ([]snapshot.Snapshot, error) {
+	return listManifests(r.taskDir(task))
+}
+
+func listManifests(dir string) ([]snapshot.Snapshot, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []snapshot.Snapshot
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), ".json")
+		if info.IsDir() || name == info.Name() {
+			continue
+		}
+		t, ok := snapshot.ParseName(name)
+		if !ok {
+			continue
+		}
+		snapshots = append(snapshots, snapshot.Snapshot{Name: name, Time: t, Path: filepath.Join(dir, info.Name())})
+	}
+	snapshot.Sort(snapshots)
+	return snapshots, nil
+}
+
+// latest return the manifest of the latest snapshot of the task, nil if none
+func (r *Repository) latest(task string) (*Manifest, error) {
+	snapshots, err := r.Snapshots(task)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		m, err := r.LoadManifest(snapshots[i])
+		if err != nil {
+			return nil, err
+		}
+		// the directory may be shared with a task of another name, see SameTaskDir
+		if m.Task == task {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// allManifests return the snapshots of all tasks in the repository
+func (r *Repository) allManifests() ([]snapshot.Snapshot, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(r.Root, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var all []snapshot.Snapshot
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		snapshots, err := listManifests(filepath.Join(r.Root, "snapshots", dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, snapshots...)
+	}
+	return all, nil
+}
@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"restore"
+	"snapshot"
+	"testing"
+	"time"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src1 := filepath.Join(dir, "src1")
+	src2 := filepath.Join(dir, "src2")
+	os.MkdirAll(filepath.Join(src1, "sub"), os.ModePerm)
+	os.MkdirAll(src2, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(src1, "same.pdf"), []byte("shared content"), 0644)
+	ioutil.WriteFile(filepath.Join(src2, "copy.pdf"), []byte("shared content"), 0644)
+	ioutil.WriteFile(filepath.Join(src1, "sub", "a.txt"), []byte("a"), 0644)
+
+	r, err := Open(filepath.Join(dir, "repo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	_, stats, err := r.Backup(context.Background(), "task1", src1, BackupOptions{}, now)
+	if err != nil || stats.Files != 2 || stats.NewBlobs != 2 {
+		t.Fatalf("backup task1: %+v %v", stats, err)
+	}
+	_, stats, err = r.Backup(context.Background(), "task2", src2, BackupOptions{}, now)
+	if err != nil || stats.Files != 1 || stats.NewBlobs != 0 {
+		t.Fatalf("identical content should be stored once: %+v %v", stats, err)
+	}
+	if _, _, err = r.Backup(context.Background(), "task2", src2, BackupOptions{}, now); err != nil {
+		t.Fatalf("backup in the same second: %v", err)
+	}
+	if s, err := r.Snapshots("task2"); err != nil || len(s) != 2 || s[1].Name != now.Format(snapshot.TimeFormat)+"-1" {
+		t.Fatalf("snapshot in the same second should get a suffix: %v %v", s, err)
+	} else if _, err = r.LoadManifest(s[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(src1, "sub", "a.txt"), []byte("a changed"), 0644)
+	_, stats, err = r.Backup(context.Background(), "task1", src1, BackupOptions{}, now.Add(time.Hour))
+	if err != nil || stats.Unchanged != 1 || stats.NewBlobs != 1 {
+		t.Fatalf("backup task1 again: %+v %v", stats, err)
+	}
+
+	snapshots, err := r.Snapshots("task1")
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("snapshots: %v %v", snapshots, err)
+	}
+	m, err := r.LoadManifest(snapshots[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "target")
+	if _, err = restore.Restore(r.Source(m), restore.Options{Target: target}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(target, "sub", "a.txt")); string(b) != "a" {
+		t.Errorf("restored old version wrong: %s", b)
+	}
+
+	// rolling the latest manifest back to an older one is refused
+	latest, _ := ioutil.ReadFile(snapshots[1].Path)
+	older, _ := ioutil.ReadFile(snapshots[0].Path)
+	ioutil.WriteFile(snapshots[1].Path, older, 0644)
+	if _, err = r.LoadManifest(snapshots[1]); err == nil {
+		t.Error("manifest rolled back to an older one should be refused")
+	}
+	ioutil.WriteFile(snapshots[1].Path, latest, 0644)
+
+	pruned, err := r.Prune("task1", &snapshot.Retention{KeepLast: 1}, now.Add(2*time.Hour))
+	if err != nil || len(pruned) != 1 {
+		t.Fatalf("prune: %v %v", pruned, err)
+	}
+	used, _ := r.usedBlobs()
+	count := 0
+	r.walkBlobs(func(id, path string, info os.FileInfo) error {
+		count++
+		if !used[id] {
+			t.Errorf("unused blob %s not collected", id)
+		}
+		return nil
+	})
+	if count != 2 {
+		t.Errorf("expect 2 blobs after gc, got %d", count)
+	}
+}
+
+func TestSharedTaskDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+	if !SameTaskDir("a/b", "A_b") || SameTaskDir("a/b", "a_c") {
+		t.Error("SameTaskDir should compare the directory names regardless of case")
+	}
+
+	r, err := Open(filepath.Join(dir, "repo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 2; i++ {
+		if _, _, err = r.Backup(context.Background(), "a/b", src, BackupOptions{}, now.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err := r.latest("a_b"); err != nil || m != nil {
+		t.Errorf("the latest snapshot of another task should not be used: %v %v", m, err)
+	}
+	if _, _, err = r.Backup(context.Background(), "a_b", src, BackupOptions{}, now); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := r.latest("a_b"); err != nil || m == nil || m.Task != "a_b" {
+		t.Errorf("latest of a_b: %v %v", m, err)
+	}
+	pruned, err := r.Prune("a_b", &snapshot.Retention{KeepLast: 1}, now.Add(time.Hour))
+	if err != nil || len(pruned) != 0 {
+		t.Errorf("the snapshots of another task should not be pruned: %v %v", pruned, err)
+	}
+	pruned, err = r.Prune("a/b", &snapshot.Retention{KeepLast: 1}, now.Add(time.Hour))
+	if err != nil || len(pruned) != 1 || pruned[0].Name != now.Format(snapshot.TimeFormat) {
+		t.Errorf("prune of a/b: %v %v", pruned, err)
+	}
+	if s, _ := r.Snapshots("a_b"); len(s) != 2 {
+		t.Errorf("snapshots after prune: %v", s)
+	}
+}
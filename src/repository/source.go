@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"io"
+	"restore"
+)
+
+// Source return the files of the snapshot for restoring
+func (r *Repository) Source(m *Manifest) restore.Source {
+	return &manifestSource{r: r, m: m}
+}
+
+type manifestSource struct {
+	r *Repository
+	m *Manifest
+}
+
+func (s *manifestSource) Files() ([]restore.File, error) {
+	files := make([]restore.File, 0, len(s.m.Files))
+	for _, n := range s.m.Files {
+		blobs := n.Blobs
+		files = append(files, restore.File{
+			Path:    n.Path,
+			Size:    n.Size,
+			Mode:    n.Mode,
+			ModTime: n.ModTime,
+			Open: func() (io.ReadCloser, error) {
+				return s.r.openBlobs(blobs), nil
+			},
+		})
+	}
+	return files, nil
+}
+
+// blobsReader reads the concatenation of blobs
+type blobsReader struct {
+	r       *Repository
+	blobs   []string
+	current io.ReadCloser
+}
+
+func (r *Repository) openBlobs(blobs []string) io.ReadCloser {
+	return &blobsReader{r: r, blobs: blobs}
+}
+
+func (b *blobsReader) Read(p []byte) (int, error) {
+	for {
+		if b.current == nil {
+			if len(b.blobs) == 0 {
+				return 0, io.EOF
+			}
+			current, err := b.r.OpenBlob(b.blobs[0])
+			if err != nil {
+				return 0, err
+			}
+			b.current = current
+			b.blobs = b.blobs[1:]
+		}
+		n, err := b.current.Read(p)
+		if err == io.EOF {
+			b.current.Close()
+			b.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (b *blobsReader) Close() error {
+	if b.current != nil {
+		return b.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package restore
+
+import (
+	"copier"
+	"errors"
+	"fmt"
+	"glog"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"values"
+)
+
+// conflict policies, used when a file to restore already exists in the target with different content
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	// restore the file next to the existing one with a "(restored n)" suffix
+	ConflictKeepBoth = "keep-both"
+)
+
+// File is a file that can be restored
+type File struct {
+	// path relative to the backup root
+	Path    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Open    func() (io.ReadCloser, error)
+}
+
+// Source lists the files of a backup version
+type Source interface {
+	Files() ([]File, error)
+}
+
+type Options struct {
+	// the directory to restore into
+	Target string
+	// only restore files whose path (relative to the backup root, separated by /) or one of its parent
+	// directories match one of the globs, or equal one of the paths. All files are restored if both are empty.
+	Globs []string
+	// the exact paths, which may contain the special characters of globs like [ or *
+	Paths    []string
+	Conflict string
+}
+
+type Summary struct {
+	Restored int
+	// files that already exist, identical or skipped by the conflict policy
+	Skipped int
+	// files restored beside an existing one with the keep-both policy
+	Renamed int
+	Failed  int
+	Bytes   int64
+	Files   []string
+	Errors  []string
+}
+
+func (s *Summary) String() string {
+	return fmt.Sprintf("restored %d (%d kept both), skipped %d, failed %d, %d bytes",
+		s.Restored, s.Renamed, s.Skipped, s.Failed, s.Bytes)
+}
+
+func ValidConflict(conflict string) bool {
+	return conflict == ConflictOverwrite || conflict == ConflictSkip || conflict == ConflictKeepBoth
+}
+
+// Match report whether the relative path rel or one of its parents matches one of globs.
+func Match(rel string, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+	for _, glob := range globs {
+		glob = strings.Trim(filepath.ToSlash(glob), "/")
+		for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			if matched, err := path.Match(glob, p); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Under report whether the relative path rel or one of its parents is one of paths, which are separated by /.
+func Under(rel string, paths []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, p := range paths {
+		p = strings.Trim(p, "/")
+		if p != "" && (rel == p || strings.HasPrefix(rel, p+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// selected report whether the file of the relative path rel is restored by the options
+func (opts *Options) selected(rel string) bool {
+	if len(opts.Paths) == 0 {
+		return Match(rel, opts.Globs)
+	}
+	return (len(opts.Globs) > 0 && Match(rel, opts.Globs)) || Under(rel, opts.Paths)
+}
+
+// Entry is a file or directory directly under a directory of a backup version
+type Entry struct {
+	Name string
+	Dir  bool
+	// the total size of the files under a directory
+	Size int64
+	// the latest modification time of the files under a directory
+	ModTime time.Time
+}
+
+// List return the entries directly under dir of files, directories first, then sorted by name.
+// dir is relative to the backup root and separated by /, the root is empty.
+func List(files []File, dir string) []Entry {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	index := make(map[string]int)
+	var entries []Entry
+	for _, f := range files {
+		if !strings.HasPrefix(f.Path, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(f.Path, prefix)
+		isDir := false
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, isDir = name[:i], true
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(entries)
+			index[name] = i
+			entries = append(entries, Entry{Name: name, Dir: isDir})
+		}
+		entries[i].Size += f.Size
+		if f.ModTime.After(entries[i].ModTime) {
+			entries[i].ModTime = f.ModTime
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Dir != entries[j].Dir {
+			return entries[i].Dir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Restore writes the files of src selected by opts.Globs and opts.Paths into opts.Target.
+func Restore(src Source, opts Options) (*Summary, error) {
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictKeepBoth
+	}
+	if !ValidConflict(opts.Conflict) {
+		return nil, errors.New("invalid conflict policy " + opts.Conflict)
+	}
+	files, err := src.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{}
+	for _, f := range files {
+		if !opts.selected(f.Path) {
+			continue
+		}
+		target, err := targetPath(opts.Target, f.Path)
+		if err != nil {
+			glog.Errorf("restore %s failed: %v", f.Path, err)
+			summary.Failed++
+			summary.Errors = append(summary.Errors, f.Path+": "+err.Error())
+			continue
+		}
+		if info, err := os.Stat(target); err == nil {
+			if info.Mode().IsRegular() && info.Size() == f.Size && sameTime(info.ModTime(), f.ModTime) {
+				summary.Skipped++
+				continue
+			}
+			switch opts.Conflict {
+			case ConflictSkip:
+				glog.V(3).Infof("skip existing file %s", target)
+				summary.Skipped++
+				continue
+			case ConflictKeepBoth:
+				target = keepBothName(target)
+				summary.Renamed++
+			}
+		}
+		if err = restoreFile(f, target); err != nil {
+			glog.Errorf("restore %s to %s failed: %v", f.Path, target, err)
+			summary.Failed++
+			summary.Errors = append(summary.Errors, f.Path+": "+err.Error())
+			continue
+		}
+		summary.Restored++
+		summary.Bytes += f.Size
+		summary.Files = append(summary.Files, target)
+	}
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("%d files failed to restore", summary.Failed)
+	}
+	return summary, nil
+}
+
+// targetPath return the path of the relative path rel under root, rel from a damaged or forged backup could
+// point outside of root, like "../x" or "/etc/x", which is refused.
+func targetPath(root, rel string) (string, error) {
+	if rel == "" || path.IsAbs(rel) || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || strings.HasPrefix(rel, `\`) {
+		return "", errors.New("invalid path " + rel + " in backup, it should be relative")
+	}
+	for _, part := range strings.FieldsFunc(rel, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return "", errors.New("invalid path " + rel + " in backup, it should not contain ..")
+		}
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	if r, err := filepath.Rel(root, target); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid path " + rel + " in backup, it is outside of " + root)
+	}
+	return target, nil
+}
+
+func sameTime(a, b time.Time) bool {
+	diff := a.Sub(b)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff < values.ModTimeTolerance
+}
+
+// keepBothName return a not existing name like "report (restored 1).txt" for target
+func keepBothName(target string) string {
+	ext := filepath.Ext(target)
+	base := strings.TrimSuffix(target, ext)
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s (restored %d)%s", base, i, ext)
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+func restoreFile(f File, target string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := target + values.TempFileSuffix
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, f.Mode.Perm()|0200)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmp, time.Now(), f.ModTime); err != nil {
+		return err
+	}
+	if _, statErr := os.Stat(target); statErr == nil {
+		os.Chmod(target, 0666)
+	}
+	return os.Rename(tmp, target)
+}
+
+// DirSource is a plain directory backup, like a copy or a snapshot.
+// If Root is a regular file, it is the only file of the source.
+type DirSource struct {
+	Root string
+	// filtered files are not restored, the temporary files of interrupted copies are always ignored
+	FilteredFiles []string
+}
+
+func (d *DirSource) Files() ([]File, error) {
+	fi, err := os.Stat(d.Root)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().IsRegular() {
+		return []File{d.file(d.Root, fi.Name(), fi)}, nil
+	}
+	var files []File
+	err = filepath.Walk(d.Root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), values.TempFileSuffix) ||
+			copier.IsFiltered(info.Name(), d.FilteredFiles) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, d.file(p, filepath.ToSlash(rel), info))
+		return nil
+	})
+	return files, err
+}
+
+func (d *DirSource) file(p, rel string, info os.FileInfo) File {
+	return File{
+		Path:    rel,
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		Open: func() (io.ReadCloser, error) {
+			return os.Open(p)
+		},
+	}
+}
@@ -0,0 +1,161 @@
+package restore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		path     string
+		globs    []string
+		expected bool
+	}{
+		{"a/b/c.txt", nil, true},
+		{"a/b/c.txt", []string{"a"}, true},
+		{"a/b/c.txt", []string{"a/*/c.txt"}, true},
+		{"a/b/c.txt", []string{"*.txt"}, false},
+		{"c.txt", []string{"*.txt"}, true},
+		{"a/b/c.txt", []string{"b"}, false},
+	}
+	for _, c := range cases {
+		if Match(c.path, c.globs) != c.expected {
+			t.Errorf("Match(%s, %v) should be %v", c.path, c.globs, c.expected)
+		}
+	}
+}
+
+func TestRestorePaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("* is not allowed in file names on windows")
+	}
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var src fileSource
+	for _, p := range []string{"a[1].txt", "a1.txt", "ab.txt", "*/x.txt", "d/x.txt", "a*b/c.txt", "a-b/c.txt"} {
+		src = append(src, File{Path: p, Size: 2, Mode: 0644, ModTime: time.Now(), Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("ok")), nil
+		}})
+	}
+	for i, c := range []struct {
+		paths    []string
+		expected int
+	}{
+		{[]string{"a[1].txt"}, 1},
+		{[]string{"*"}, 1},
+		{[]string{"a*b"}, 1},
+		{[]string{"a[1].txt", "/d/"}, 2},
+		{[]string{"a"}, 0},
+	} {
+		summary, err := Restore(src, Options{Target: filepath.Join(dir, strconv.Itoa(i)), Paths: c.paths})
+		if err != nil || summary.Restored != c.expected {
+			t.Errorf("restore paths %v: %v %v, expected %d restored", c.paths, summary, err, c.expected)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backup := filepath.Join(dir, "backup")
+	target := filepath.Join(dir, "target")
+	os.MkdirAll(filepath.Join(backup, "docs"), os.ModePerm)
+	os.MkdirAll(target, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(backup, "docs", "a.txt"), []byte("backup"), 0644)
+	ioutil.WriteFile(filepath.Join(backup, "b.txt"), []byte("b"), 0644)
+	ioutil.WriteFile(filepath.Join(target, "b.txt"), []byte("broken"), 0644)
+
+	src := &DirSource{Root: backup}
+	summary, err := Restore(src, Options{Target: target, Globs: []string{"docs"}})
+	if err != nil || summary.Restored != 1 {
+		t.Fatalf("restore docs failed: %v %v", summary, err)
+	}
+
+	summary, err = Restore(src, Options{Target: target, Conflict: ConflictSkip})
+	if err != nil || summary.Restored != 0 || summary.Skipped != 2 {
+		t.Errorf("existing files should be skipped: %v %v", summary, err)
+	}
+
+	summary, err = Restore(src, Options{Target: target, Conflict: ConflictKeepBoth})
+	if err != nil || summary.Renamed != 1 {
+		t.Errorf("b.txt should be kept both: %v %v", summary, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(target, "b (restored 1).txt")); string(b) != "b" {
+		t.Error("b.txt not restored beside the existing one")
+	}
+
+	summary, err = Restore(src, Options{Target: target, Conflict: ConflictOverwrite})
+	if err != nil || summary.Restored != 1 || summary.Skipped != 1 {
+		t.Errorf("b.txt should be overwritten: %v %v", summary, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(target, "b.txt")); string(b) != "b" {
+		t.Error("b.txt not overwritten")
+	}
+}
+
+type fileSource []File
+
+func (s fileSource) Files() ([]File, error) {
+	return s, nil
+}
+
+func TestRestoreOutsideTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "a", "target")
+	var src fileSource
+	for _, p := range []string{"../../escaped.txt", "docs/../../escaped.txt", "/escaped.txt", `..\escaped.txt`, "ok.txt"} {
+		src = append(src, File{Path: p, Size: 2, Mode: 0644, ModTime: time.Now(), Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("ok")), nil
+		}})
+	}
+	summary, err := Restore(src, Options{Target: target})
+	if err == nil || summary.Restored != 1 || summary.Failed != 4 {
+		t.Errorf("paths outside of the target should fail: %v %v", summary, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("file restored outside of the target")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(target, "ok.txt")); string(b) != "ok" {
+		t.Error("ok.txt not restored")
+	}
+}
+
+func TestList(t *testing.T) {
+	now := time.Now()
+	files := []File{
+		{Path: "b.txt", Size: 1, ModTime: now},
+		{Path: "docs/a.txt", Size: 2, ModTime: now.Add(-time.Hour)},
+		{Path: "docs/sub/c.txt", Size: 3, ModTime: now},
+		{Path: "a.txt", Size: 4, ModTime: now},
+	}
+	entries := List(files, "")
+	if len(entries) != 3 || entries[0].Name != "docs" || !entries[0].Dir || entries[0].Size != 5 ||
+		!entries[0].ModTime.Equal(now) || entries[1].Name != "a.txt" || entries[2].Name != "b.txt" {
+		t.Errorf("root entries = %+v", entries)
+	}
+	entries = List(files, "/docs/")
+	if len(entries) != 2 || entries[0].Name != "sub" || !entries[0].Dir || entries[1].Name != "a.txt" ||
+		entries[1].Dir || entries[1].Size != 2 {
+		t.Errorf("docs entries = %+v", entries)
+	}
+	if entries = List(files, "missing"); len(entries) != 0 {
+		t.Errorf("missing entries = %+v", entries)
+	}
+}
@@ -0,0 +1,222 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	// time zones on systems without zoneinfo, like windows
+	_ "time/tzdata"
+)
+
+// Cron is a standard five fields cron expression: minute hour day-of-month month day-of-week.
+// A field is *, a number, a range 1-5, a list 1,3,5 or a step */15 and 1-30/2. Months and weekdays
+// can be names like JAN and MON, 0 and 7 are both Sunday. A weekday can be followed by #n for the n-th
+// weekday of the month, like SUN#1 for the first Sunday. As in vixie cron, if both day-of-month and
+// day-of-week are restricted, a day matching either of them matches.
+// Shortcuts @yearly (@annually), @monthly, @weekly, @daily (@midnight) and @hourly are supported.
+type Cron struct {
+	spec                     string
+	minute, hour, dom, month uint64
+	dow                      uint64
+	// nth weekdays, bit n-1 of nthDow[weekday] is set for weekday#n
+	nthDow           [7]uint8
+	domStar, dowStar bool
+	loc              *time.Location
+}
+
+var shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6, "JUL": 7, "AUG": 8,
+	"SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12}
+
+var dowNames = map[string]int{"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6}
+
+// ParseCron parses spec, the times of the schedule are wall clock times in loc (time.Local if nil).
+func ParseCron(spec string, loc *time.Location) (*Cron, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	expr := strings.TrimSpace(spec)
+	if strings.HasPrefix(expr, "@") {
+		full, ok := shortcuts[strings.ToLower(expr)]
+		if !ok {
+			return nil, errors.New("unknown schedule " + spec)
+		}
+		expr = full
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("schedule " + spec + " should have 5 fields: minute hour day-of-month month day-of-week")
+	}
+
+	c := &Cron{spec: spec, loc: loc}
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.New("invalid minute of schedule " + spec + ": " + err.Error())
+	}
+	if c.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.New("invalid hour of schedule " + spec + ": " + err.Error())
+	}
+	if c.dom, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.New("invalid day of month of schedule " + spec + ": " + err.Error())
+	}
+	if c.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, errors.New("invalid month of schedule " + spec + ": " + err.Error())
+	}
+	if err = c.parseDow(fields[4]); err != nil {
+		return nil, errors.New("invalid day of week of schedule " + spec + ": " + err.Error())
+	}
+	c.domStar = fields[2] == "*" || fields[2] == "?"
+	c.dowStar = fields[4] == "*" || fields[4] == "?"
+	return c, nil
+}
+
+func (c *Cron) String() string {
+	return c.spec
+}
+
+func (c *Cron) parseDow(field string) error {
+	var plain []string
+	for _, part := range strings.Split(field, ",") {
+		i := strings.Index(part, "#")
+		if i < 0 {
+			plain = append(plain, part)
+			continue
+		}
+		day, err := parseValue(part[:i], 0, 7, dowNames)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n < 1 || n > 5 {
+			return errors.New("invalid #n in " + part + ", n should be 1 ~ 5")
+		}
+		c.nthDow[day%7] |= 1 << uint(n-1)
+	}
+	if len(plain) > 0 {
+		bits, err := parseField(strings.Join(plain, ","), 0, 7, dowNames)
+		if err != nil {
+			return err
+		}
+		// 7 is Sunday as well
+		if bits&(1<<7) != 0 {
+			bits |= 1
+		}
+		c.dow = bits &^ (1 << 7)
+	}
+	return nil
+}
+
+// parseField return the bit set of the values of field
+func parseField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, errors.New("invalid step in " + part)
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		if part != "*" && part != "?" {
+			var err error
+			if i := strings.Index(part, "-"); i >= 0 {
+				if start, err = parseValue(part[:i], min, max, names); err != nil {
+					return 0, err
+				}
+				if end, err = parseValue(part[i+1:], min, max, names); err != nil {
+					return 0, err
+				}
+			} else {
+				if start, err = parseValue(part, min, max, names); err != nil {
+					return 0, err
+				}
+				// 5/10 means from 5 to the max every 10
+				if step == 1 {
+					end = start
+				}
+			}
+			if start > end {
+				return 0, errors.New("invalid range " + part)
+			}
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, min, max int, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.New("invalid value " + s)
+	}
+	if v < min || v > max {
+		return 0, errors.New(s + " out of range " + strconv.Itoa(min) + " ~ " + strconv.Itoa(max))
+	}
+	return v, nil
+}
+
+func (c *Cron) dayMatches(year int, month time.Month, day int) bool {
+	weekday := int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday())
+	domMatch := c.dom&(1<<uint(day)) != 0
+	dowMatch := c.dow&(1<<uint(weekday)) != 0 || c.nthDow[weekday]&(1<<uint((day-1)/7)) != 0
+	if c.domStar || c.dowStar {
+		return (c.domStar || domMatch) && (c.dowStar || dowMatch)
+	}
+	return domMatch || dowMatch
+}
+
+// Next return the first time of the schedule after t.
+// Wall clock times skipped by a daylight saving change run at the first time after the gap,
+// times repeated by a daylight saving change run once.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.In(c.loc)
+	// the wall clock of the next minute, days are counted in UTC to avoid daylight saving changes
+	start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	// any valid expression matches in 5 years, Feb 29 needs 4
+	for end := day.AddDate(5, 0, 0); day.Before(end); day = day.AddDate(0, 0, 1) {
+		if c.month&(1<<uint(day.Month())) == 0 || !c.dayMatches(day.Year(), day.Month(), day.Day()) {
+			continue
+		}
+		for h := 0; h < 24; h++ {
+			if c.hour&(1<<uint(h)) == 0 {
+				continue
+			}
+			for m := 0; m < 60; m++ {
+				if c.minute&(1<<uint(m)) == 0 {
+					continue
+				}
+				wall := day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+				if wall.Before(start) {
+					continue
+				}
+				next := time.Date(wall.Year(), wall.Month(), wall.Day(), h, m, 0, 0, c.loc)
+				// the wall clock does not exist, move to the same distance after the gap
+				if got := time.Date(next.Year(), next.Month(), next.Day(), next.Hour(), next.Minute(), 0, 0, time.UTC); !got.Equal(wall) {
+					next = next.Add(wall.Sub(got))
+				}
+				if next.After(t) {
+					return next
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,84 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{"* * * * *", "30 2 * * 1-5", "0 0 * * SUN#1", "*/15 0-6/2 1,15 JAN-jun mon", "@daily", "@Hourly", "0 0 * * 7"}
+	for _, spec := range valid {
+		if _, err := ParseCron(spec, time.UTC); err != nil {
+			t.Errorf("ParseCron(%q) error: %v", spec, err)
+		}
+	}
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "5-1 * * * *",
+		"*/0 * * * *", "* * * * MON#6", "@often", "a * * * *"}
+	for _, spec := range invalid {
+		if _, err := ParseCron(spec, time.UTC); err == nil {
+			t.Errorf("ParseCron(%q) should fail", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	cases := []struct {
+		spec, from, want string
+	}{
+		{"30 2 * * 1-5", "2026-10-16 02:30", "2026-10-19 02:30"},
+		{"30 2 * * 1-5", "2026-10-19 01:00", "2026-10-19 02:30"},
+		{"0 0 * * SUN#1", "2026-10-17 12:00", "2026-11-01 00:00"},
+		{"0 0 * * SUN#1", "2026-11-01 00:00", "2026-12-06 00:00"},
+		{"@monthly", "2026-12-15 08:00", "2027-01-01 00:00"},
+		{"*/20 * * * *", "2026-10-17 23:59", "2026-10-18 00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		// either day of month or day of week
+		{"0 0 13 * FRI", "2026-10-17 00:00", "2026-10-23 00:00"},
+		{"0 12 13 * FRI", "2026-11-06 12:00", "2026-11-13 12:00"},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.spec, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, _ := time.ParseInLocation("2006-01-02 15:04", c.from, time.UTC)
+		want, _ := time.ParseInLocation("2006-01-02 15:04", c.want, time.UTC)
+		if got := cron.Next(from); !got.Equal(want) {
+			t.Errorf("%q.Next(%s) = %s, want %s", c.spec, c.from, got, c.want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2026-03-08 02:00 jumps to 03:00, the 02:30 run happens at 03:30 EDT once
+	cron, _ := ParseCron("30 2 * * *", loc)
+	next := cron.Next(time.Date(2026, 3, 8, 0, 0, 0, 0, loc))
+	if want := time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("next in gap = %s, want %s", next, want)
+	}
+	if next = cron.Next(next); !next.Equal(time.Date(2026, 3, 9, 6, 30, 0, 0, time.UTC)) {
+		t.Errorf("next after gap = %s", next.UTC())
+	}
+
+	// 2026-11-01 02:00 goes back to 01:00, the 01:30 run happens once
+	cron, _ = ParseCron("30 1 * * *", loc)
+	first := cron.Next(time.Date(2026, 11, 1, 0, 0, 0, 0, loc))
+	if first.Hour() != 1 || first.Minute() != 30 || first.Day() != 1 {
+		t.Errorf("next in overlap = %s", first)
+	}
+	if next = cron.Next(first); next.Day() != 2 || next.Hour() != 1 || next.Minute() != 30 {
+		t.Errorf("next after overlap = %s, want 01:30 the next day", next)
+	}
+
+	// hourly runs keep an hour apart in real time across the overlap
+	cron, _ = ParseCron("@hourly", loc)
+	t1 := cron.Next(time.Date(2026, 11, 1, 0, 30, 0, 0, loc))
+	t2 := cron.Next(t1)
+	if t2.Sub(t1) <= 0 {
+		t.Errorf("hourly runs %s and %s are not increasing", t1, t2)
+	}
+}
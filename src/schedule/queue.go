@@ -0,0 +1,104 @@
+package schedule
+
+import (
+	"sort"
+	"sync"
+)
+
+// Queue limits the number of jobs running at the same time.
+// Waiting jobs get a free slot by priority, higher first, and in order of arrival for the same priority.
+type Queue struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	seq     uint64
+	waiting []*waiter
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+// NewQueue return a queue running at most limit jobs at the same time, no limit if limit <= 0
+func NewQueue(limit int) *Queue {
+	return &Queue{limit: limit}
+}
+
+// SetLimit changes the limit, jobs already running are not affected
+func (q *Queue) SetLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = limit
+	q.dispatch()
+}
+
+// Acquire blocks until a slot is free, it return false if stop is closed before.
+// Release must be called after the job if it return true.
+func (q *Queue) Acquire(priority int, stop <-chan struct{}) bool {
+	q.mu.Lock()
+	if len(q.waiting) == 0 && (q.limit <= 0 || q.running < q.limit) {
+		q.running++
+		q.mu.Unlock()
+		return true
+	}
+	q.seq++
+	w := &waiter{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	i := sort.Search(len(q.waiting), func(i int) bool {
+		return q.waiting[i].priority < priority
+	})
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = w
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-stop:
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i := range q.waiting {
+			if q.waiting[i] == w {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				return false
+			}
+		}
+		// the slot was given at the same time, pass it on
+		q.running--
+		q.dispatch()
+		return false
+	}
+}
+
+// Release frees the slot of a finished job
+func (q *Queue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	q.dispatch()
+}
+
+// Full report whether a new job has to wait
+func (q *Queue) Full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting) > 0 || (q.limit > 0 && q.running >= q.limit)
+}
+
+// Stat return the number of running and waiting jobs
+func (q *Queue) Stat() (running, waiting int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running, len(q.waiting)
+}
+
+func (q *Queue) dispatch() {
+	for len(q.waiting) > 0 && (q.limit <= 0 || q.running < q.limit) {
+		w := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		close(w.ready)
+	}
+}
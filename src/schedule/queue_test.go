@@ -0,0 +1,59 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(1)
+	stop := make(chan struct{})
+	if !q.Acquire(0, stop) {
+		t.Fatal("the first job should run")
+	}
+	if !q.Full() {
+		t.Error("queue of limit 1 should be full")
+	}
+
+	order := make(chan int, 3)
+	for _, p := range []int{1, 5, 1} {
+		go func(p int) {
+			if q.Acquire(p, stop) {
+				order <- p
+				q.Release()
+			}
+		}(p)
+		// keep the arrival order
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancelled := make(chan struct{})
+	result := make(chan bool)
+	go func() { result <- q.Acquire(9, cancelled) }()
+	time.Sleep(10 * time.Millisecond)
+	close(cancelled)
+	if <-result {
+		t.Error("Acquire should fail when stopped")
+	}
+	if running, waiting := q.Stat(); running != 1 || waiting != 3 {
+		t.Errorf("Stat() = %d, %d", running, waiting)
+	}
+
+	q.Release()
+	for _, want := range []int{5, 1, 1} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Errorf("got priority %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waiting jobs are not run")
+		}
+	}
+
+	q.SetLimit(0)
+	for i := 0; i < 3; i++ {
+		if !q.Acquire(0, stop) {
+			t.Fatal("unlimited queue should not block")
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// window is a daily time range on some weekdays. If end is not after start the range
+// crosses midnight, it begins on the listed days and ends on the day after.
+type window struct {
+	// bit n is set for time.Weekday n
+	days uint8
+	// minutes of the day, end can be 24*60
+	start, end int
+}
+
+// Windows are the time ranges a task is allowed to run in, like "Mon-Fri 19:00-07:00".
+// A window is "[days] [HH:MM-HH:MM]": days is a list or range of weekday names, all days if omitted,
+// and the time range is the whole day if omitted. The times are wall clock times in the location.
+type Windows struct {
+	list []window
+	loc  *time.Location
+}
+
+// ParseWindows parses specs in loc (time.Local if nil), it return nil if specs is empty.
+func ParseWindows(specs []string, loc *time.Location) (*Windows, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	w := &Windows{loc: loc}
+	for _, spec := range specs {
+		win, err := parseWindow(spec)
+		if err != nil {
+			return nil, errors.New("invalid window " + spec + ": " + err.Error())
+		}
+		w.list = append(w.list, win)
+	}
+	return w, nil
+}
+
+func parseWindow(spec string) (window, error) {
+	win := window{days: 0x7f, start: 0, end: 24 * 60}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return win, errors.New("should be [days] [HH:MM-HH:MM]")
+	}
+	days, timeRange := fields[0], ""
+	if len(fields) == 2 {
+		timeRange = fields[1]
+	} else if strings.Contains(days, ":") {
+		days, timeRange = "", days
+	}
+	if days != "" {
+		bits, err := parseField(days, 0, 7, dowNames)
+		if err != nil {
+			return win, err
+		}
+		// 7 is Sunday as well
+		if bits&(1<<7) != 0 {
+			bits |= 1
+		}
+		win.days = uint8(bits & 0x7f)
+	}
+	if timeRange != "" {
+		i := strings.Index(timeRange, "-")
+		if i < 0 {
+			return win, errors.New("time range should be HH:MM-HH:MM")
+		}
+		var err error
+		if win.start, err = parseClock(timeRange[:i]); err != nil {
+			return win, err
+		}
+		if win.end, err = parseClock(timeRange[i+1:]); err != nil {
+			return win, err
+		}
+		if win.start == 24*60 {
+			return win, errors.New("start can not be 24:00")
+		}
+	}
+	return win, nil
+}
+
+// parseClock return the minutes of the day of HH:MM, 24:00 is allowed as the end of the day
+func parseClock(s string) (int, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return 0, errors.New("invalid time " + s)
+	}
+	h, err1 := strconv.Atoi(s[:i])
+	m, err2 := strconv.Atoi(s[i+1:])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, errors.New("invalid time " + s)
+	}
+	return h*60 + m, nil
+}
+
+func (w window) contains(weekday time.Weekday, minute int) bool {
+	if w.start < w.end {
+		return w.days&(1<<uint(weekday)) != 0 && minute >= w.start && minute < w.end
+	}
+	yesterday := (weekday + 6) % 7
+	return (w.days&(1<<uint(weekday)) != 0 && minute >= w.start) ||
+		(w.days&(1<<uint(yesterday)) != 0 && minute < w.end)
+}
+
+// Open report whether t is in one of the windows
+func (w *Windows) Open(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	for _, win := range w.list {
+		if win.contains(t.Weekday(), minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen return t if it is in a window, or the time the next window opens.
+// It return the zero time if no window ever opens.
+func (w *Windows) NextOpen(t time.Time) time.Time {
+	if w.Open(t) {
+		return t
+	}
+	return w.nextChange(t, true)
+}
+
+// NextClose return the time the window t is in closes, t if it is not in a window,
+// or the zero time if the windows never close.
+func (w *Windows) NextClose(t time.Time) time.Time {
+	if !w.Open(t) {
+		return t
+	}
+	return w.nextChange(t, false)
+}
+
+// nextChange return the first minute after t whose Open is open, searching a week and a day.
+// Real minutes are stepped, so the wall clock changes of daylight saving are followed.
+func (w *Windows) nextChange(t time.Time, open bool) time.Time {
+	next := t.Truncate(time.Minute)
+	for end := t.Add(8 * 24 * time.Hour); next.Before(end); {
+		next = next.Add(time.Minute)
+		if w.Open(next) == open {
+			return next
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,56 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindows(t *testing.T) {
+	if w, err := ParseWindows(nil, time.UTC); w != nil || err != nil {
+		t.Errorf("ParseWindows(nil) = %v, %v", w, err)
+	}
+	for _, spec := range []string{"", "Mon-Fri 19:00", "Mon-Fri 25:00-07:00", "Mon 24:00-01:00", "Fri-Mon", "a b c"} {
+		if _, err := ParseWindows([]string{spec}, time.UTC); err == nil {
+			t.Errorf("ParseWindows(%q) should fail", spec)
+		}
+	}
+
+	w, err := ParseWindows([]string{"Mon-Fri 19:00-07:00", "Sat,Sun"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		return tm
+	}
+	cases := []struct {
+		now        string
+		open       bool
+		next, stop string
+	}{
+		// 2026-10-19 is a Monday
+		{"2026-10-19 10:00", false, "2026-10-19 19:00", "2026-10-19 10:00"},
+		{"2026-10-19 19:00", true, "2026-10-19 19:00", "2026-10-20 07:00"},
+		{"2026-10-20 06:59", true, "2026-10-20 06:59", "2026-10-20 07:00"},
+		// the friday night window runs into the weekend, windows starting on monday do not cover sunday night
+		{"2026-10-23 22:00", true, "2026-10-23 22:00", "2026-10-26 00:00"},
+		{"2026-10-26 08:00", false, "2026-10-26 19:00", "2026-10-26 08:00"},
+	}
+	for _, c := range cases {
+		now := at(c.now)
+		if got := w.Open(now); got != c.open {
+			t.Errorf("Open(%s) = %v", c.now, got)
+		}
+		if got := w.NextOpen(now); !got.Equal(at(c.next)) {
+			t.Errorf("NextOpen(%s) = %s, want %s", c.now, got, c.next)
+		}
+		if got := w.NextClose(now); !got.Equal(at(c.stop)) {
+			t.Errorf("NextClose(%s) = %s, want %s", c.now, got, c.stop)
+		}
+	}
+
+	always, _ := ParseWindows([]string{"00:00-24:00"}, time.UTC)
+	if !always.NextClose(at("2026-10-19 10:00")).IsZero() {
+		t.Error("a window of all days should never close")
+	}
+}
@@ -0,0 +1,122 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"glog"
+	"os"
+	"time"
+	"util"
+)
+
+// Retention decides which snapshots to keep, a snapshot is kept if any of the rules keeps it.
+// The newest snapshot is always kept.
+type Retention struct {
+	// keep the newest n snapshots
+	KeepLast int `yaml:"keep_last"`
+	// keep the newest snapshot of each of the last n days, weeks, months and years which have snapshots
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+	// keep all snapshots newer than the duration, like 10d, in the format of task period
+	KeepWithin string `yaml:"keep_within"`
+	// only log the snapshots that would be pruned
+	DryRun bool `yaml:"dry_run"`
+}
+
+func (r *Retention) Validate() error {
+	if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 || r.KeepYearly < 0 {
+		return errors.New("retention count can not be negative")
+	}
+	if r.KeepWithin != "" {
+		if _, err := util.ParseDuration(r.KeepWithin); err != nil {
+			return errors.New("invalid keep_within " + r.KeepWithin + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// IsEmpty report whether no rule is configured, which means keep everything.
+func (r *Retention) IsEmpty() bool {
+	return r.KeepLast == 0 && r.KeepDaily == 0 && r.KeepWeekly == 0 && r.KeepMonthly == 0 &&
+		r.KeepYearly == 0 && r.KeepWithin == ""
+}
+
+type bucketRule struct {
+	count int
+	key   func(s Snapshot) string
+}
+
+// Apply splits snapshots into the ones to keep and the ones to prune, both oldest first.
+func (r *Retention) Apply(snapshots []Snapshot, now time.Time) (keep, prune []Snapshot) {
+	if r.IsEmpty() || len(snapshots) == 0 {
+		return snapshots, nil
+	}
+	sorted := make([]Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	// newest first, snapshots taken in the same second by their suffix
+	Sort(sorted)
+	for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	}
+
+	var within time.Duration
+	if r.KeepWithin != "" {
+		within, _ = util.ParseDuration(r.KeepWithin)
+	}
+	rules := []bucketRule{
+		{r.KeepLast, func(s Snapshot) string { return s.Name }},
+		{r.KeepDaily, func(s Snapshot) string { return s.Time.Format("2006-01-02") }},
+		{r.KeepWeekly, func(s Snapshot) string {
+			year, week := s.Time.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{r.KeepMonthly, func(s Snapshot) string { return s.Time.Format("2006-01") }},
+		{r.KeepYearly, func(s Snapshot) string { return s.Time.Format("2006") }},
+	}
+	lastKeys := make([]string, len(rules))
+
+	for i, s := range sorted {
+		kept := i == 0 || (within > 0 && now.Sub(s.Time) <= within)
+		for j := range rules {
+			if rules[j].count <= 0 {
+				continue
+			}
+			key := rules[j].key(s)
+			if key != lastKeys[j] {
+				lastKeys[j] = key
+				rules[j].count--
+				kept = true
+			}
+		}
+		if kept {
+			keep = append([]Snapshot{s}, keep...)
+		} else {
+			prune = append([]Snapshot{s}, prune...)
+		}
+	}
+	return keep, prune
+}
+
+// Prune removes the snapshots under root which are not kept by the retention,
+// and return the pruned (or would be pruned in dry run) snapshots.
+func Prune(root string, r *Retention, now time.Time) ([]Snapshot, error) {
+	snapshots, err := List(root)
+	if err != nil {
+		return nil, err
+	}
+	_, prune := r.Apply(snapshots, now)
+	for _, s := range prune {
+		if r.DryRun {
+			glog.Infof("dry run: would prune snapshot %s", s.Path)
+			continue
+		}
+		glog.Infof("prune snapshot %s", s.Path)
+		if err = os.RemoveAll(s.Path); err != nil {
+			glog.Errorf("prune snapshot %s failed: %v", s.Path, err)
+			return prune, err
+		}
+	}
+	return prune, nil
+}
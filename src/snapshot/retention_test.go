@@ -0,0 +1,69 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+)
+
+func names(snapshots []Snapshot) []string {
+	var result []string
+	for _, s := range snapshots {
+		result = append(result, s.Name)
+	}
+	return result
+}
+
+func TestRetentionApply(t *testing.T) {
+	var snapshots []Snapshot
+	// two snapshots a day for 60 days, 2020-01-01 ~ 2020-02-29
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 120; i++ {
+		st := start.Add(time.Duration(i) * 12 * time.Hour)
+		snapshots = append(snapshots, Snapshot{Name: st.Format(TimeFormat), Time: st})
+	}
+	now := snapshots[len(snapshots)-1].Time.Add(time.Hour)
+
+	cases := []struct {
+		retention Retention
+		keep      int
+	}{
+		{Retention{}, 120},
+		{Retention{KeepLast: 3}, 3},
+		{Retention{KeepDaily: 7}, 7},
+		{Retention{KeepMonthly: 12}, 2},
+		{Retention{KeepYearly: 1}, 1},
+		{Retention{KeepWithin: "2d"}, 4},
+		{Retention{KeepLast: 1, KeepMonthly: 3}, 2},
+		{Retention{KeepDaily: 2, KeepWithin: "1d"}, 3},
+	}
+	for _, c := range cases {
+		keep, prune := c.retention.Apply(snapshots, now)
+		if len(keep) != c.keep || len(keep)+len(prune) != len(snapshots) {
+			t.Errorf("%+v: keep %d, prune %d, expected keep %d", c.retention, len(keep), len(prune), c.keep)
+		}
+	}
+
+	keep, _ := (&Retention{KeepMonthly: 12}).Apply(snapshots, now)
+	expected := []string{"2020-01-31_120000", "2020-02-29_120000"}
+	if got := names(keep); len(got) != 2 || got[0] != expected[0] || got[1] != expected[1] {
+		t.Errorf("monthly should keep the last snapshot of each month, got %v", got)
+	}
+}
+
+func TestRetentionSameSecond(t *testing.T) {
+	st := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	name := st.Format(TimeFormat)
+	// the newest one listed first, as their times are equal
+	snapshots := []Snapshot{{Name: name + "-1", Time: st}, {Name: name, Time: st},
+		{Name: st.Add(-time.Hour).Format(TimeFormat), Time: st.Add(-time.Hour)}}
+	for i := 0; i < 10; i++ {
+		keep, prune := (&Retention{KeepDaily: 1}).Apply(snapshots, st)
+		if got := names(keep); len(got) != 1 || got[0] != name+"-1" || len(prune) != 2 {
+			t.Fatalf("the newest snapshot should be kept, got %v", got)
+		}
+	}
+	keep, _ := (&Retention{KeepLast: 2}).Apply(snapshots, st)
+	if got := names(keep); len(got) != 2 || got[0] != name || got[1] != name+"-1" {
+		t.Errorf("keep_last should count snapshots of the same second, got %v", got)
+	}
+}
@@ -0,0 +1,154 @@
+package snapshot
+
+import (
+	"glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the name format of snapshot directories. The snapshots after the first one taken in
+// the same second get a suffix like "-1", see UniqueName.
+const TimeFormat = "2006-01-02_150405"
+
+// a snapshot is written to a directory with this suffix and renamed when it is complete
+const partialSuffix = ".partial"
+
+// Snapshot is a complete copy of the task source taken at Time
+type Snapshot struct {
+	Name string
+	Time time.Time
+	Path string
+}
+
+// ParseName return the time of the snapshot name, and false if it is not a snapshot name
+func ParseName(name string) (time.Time, bool) {
+	if len(name) > len(TimeFormat) && !validSuffix(name[len(TimeFormat):]) {
+		return time.Time{}, false
+	}
+	if len(name) > len(TimeFormat) {
+		name = name[:len(TimeFormat)]
+	}
+	t, err := time.ParseInLocation(TimeFormat, name, time.Local)
+	return t, err == nil
+}
+
+// validSuffix report whether suffix is like "-1"
+func validSuffix(suffix string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(suffix, "-"))
+	return err == nil && n > 0 && suffix == "-"+strconv.Itoa(n)
+}
+
+// Matches report whether name is a snapshot name of the time t
+func Matches(name string, t time.Time) bool {
+	_, ok := ParseName(name)
+	return ok && strings.HasPrefix(name, t.Format(TimeFormat))
+}
+
+// UniqueName return the snapshot name of now, with a suffix if the name is taken
+func UniqueName(now time.Time, taken func(name string) bool) string {
+	name := now.Format(TimeFormat)
+	for i := 1; taken(name); i++ {
+		name = now.Format(TimeFormat) + "-" + strconv.Itoa(i)
+	}
+	return name
+}
+
+// Sort sorts snapshots oldest first, the ones of the same second by their suffix
+func Sort(snapshots []Snapshot) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].Time.Equal(snapshots[j].Time) {
+			return snapshots[i].Time.Before(snapshots[j].Time)
+		}
+		a, b := snapshots[i].Name, snapshots[j].Name
+		return len(a) < len(b) || (len(a) == len(b) && a < b)
+	})
+}
+
+// List return the complete snapshots under root, oldest first.
+func List(root string) ([]Snapshot, error) {
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		t, ok := ParseName(info.Name())
+		if !ok {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Name: info.Name(), Time: t, Path: filepath.Join(root, info.Name())})
+	}
+	Sort(snapshots)
+	return snapshots, nil
+}
+
+// Latest return the newest snapshot under root, or nil if there is none.
+func Latest(root string) (*Snapshot, error) {
+	snapshots, err := List(root)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	return &snapshots[len(snapshots)-1], nil
+}
+
+// Create makes a new snapshot under root named after now, with a suffix if a snapshot of the same second exists.
+// fill writes the snapshot content into dir, prev is the latest snapshot which unchanged files
+// can be linked to, it is nil for the first snapshot.
+// The snapshot only becomes visible to List when fill succeeds.
+func Create(root string, now time.Time, fill func(dir string, prev *Snapshot) error) (*Snapshot, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	removePartial(root)
+
+	prev, err := Latest(root)
+	if err != nil {
+		return nil, err
+	}
+	name := UniqueName(now, func(name string) bool {
+		_, err := os.Lstat(filepath.Join(root, name))
+		return err == nil
+	})
+	path := filepath.Join(root, name)
+
+	partial := path + partialSuffix
+	if err = os.Mkdir(partial, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err = fill(partial, prev); err != nil {
+		glog.Warningf("snapshot %s failed, remove it: %v", partial, err)
+		os.RemoveAll(partial)
+		return nil, err
+	}
+	if err = os.Rename(partial, path); err != nil {
+		os.RemoveAll(partial)
+		return nil, err
+	}
+	t, _ := ParseName(name)
+	return &Snapshot{Name: name, Time: t, Path: path}, nil
+}
+
+// removePartial removes snapshots left by interrupted runs
+func removePartial(root string) {
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() && strings.HasSuffix(info.Name(), partialSuffix) {
+			glog.Warningf("remove incomplete snapshot %s", info.Name())
+			os.RemoveAll(filepath.Join(root, info.Name()))
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package snapshot
+
+import (
+	"context"
+	"copier"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	root := filepath.Join(dir, "dst")
+	os.MkdirAll(src, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(src, "same.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "changed.txt"), []byte("v1"), 0644)
+
+	n := &copier.Native{}
+	fill := func(dir string, prev *Snapshot) error {
+		opts := copier.Options{}
+		if prev != nil {
+			opts.LinkDest = prev.Path
+		}
+		_, err := n.Copy(context.Background(), src, dir, opts)
+		return err
+	}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	first, err := Create(root, now, fill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Create(root, now, fill)
+	if err != nil || again.Name != first.Name+"-1" || !again.Time.Equal(first.Time) {
+		t.Fatalf("snapshot of the same second should get a suffix: %+v %v", again, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(src, "changed.txt"), []byte("v2 changed"), 0644)
+	second, err := Create(root, now.Add(time.Hour), fill)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := List(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 3 || snapshots[0].Name != first.Name || snapshots[1].Name != again.Name ||
+		snapshots[2].Name != second.Name {
+		t.Fatalf("unexpected snapshots: %+v", snapshots)
+	}
+
+	a, _ := os.Stat(filepath.Join(first.Path, "same.txt"))
+	b, _ := os.Stat(filepath.Join(second.Path, "same.txt"))
+	if !os.SameFile(a, b) {
+		t.Error("unchanged file should be hard linked")
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(first.Path, "changed.txt")); string(content) != "v1" {
+		t.Errorf("first snapshot changed: %s", content)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(second.Path, "changed.txt")); string(content) != "v2 changed" {
+		t.Errorf("second snapshot wrong: %s", content)
+	}
+}
+
+func TestParseName(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	for name, ok := range map[string]bool{
+		"2020-01-02_030405":         true,
+		"2020-01-02_030405-1":       true,
+		"2020-01-02_030405-12":      true,
+		"2020-01-02_030405-0":       false,
+		"2020-01-02_030405-01":      false,
+		"2020-01-02_030405-+1":      false,
+		"2020-01-02_030405x":        false,
+		"2020-01-02_030405.partial": false,
+	} {
+		parsed, valid := ParseName(name)
+		if valid != ok || (ok && !parsed.Equal(at)) || Matches(name, at) != ok {
+			t.Errorf("ParseName(%v) = %v %v", name, parsed, valid)
+		}
+	}
+
+	snapshots := []Snapshot{{Name: "2020-01-02_030405-10"}, {Name: "2020-01-02_030405-2"}, {Name: "2020-01-02_030405"}}
+	for i := range snapshots {
+		snapshots[i].Time, _ = ParseName(snapshots[i].Name)
+	}
+	Sort(snapshots)
+	if snapshots[0].Name != "2020-01-02_030405" || snapshots[1].Name != "2020-01-02_030405-2" {
+		t.Errorf("sorted snapshots: %+v", snapshots)
+	}
+}
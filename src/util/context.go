@@ -0,0 +1,19 @@
+package util
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReader stops reading once ctx is done, so a long copy can be cancelled between reads
+type ContextReader struct {
+	Ctx    context.Context
+	Reader io.Reader
+}
+
+func (r *ContextReader) Read(p []byte) (int, error) {
+	if err := r.Ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,6 @@
+package util
+
+import "errors"
+
+// ErrLocked is returned by LockFile if the lock is held by another process, or another lock of this process
+var ErrLocked = errors.New("locked by another process")
@@ -0,0 +1,28 @@
+//go:build !unix && !windows
+
+package util
+
+import "os"
+
+// FileLock is an exclusive lock of a file, it is released by Unlock.
+// Without file locks of the system, a lock is only the existence of its file.
+type FileLock struct {
+	path string
+}
+
+// LockFile takes the lock of the file at path, it return ErrLocked at once if the lock is held.
+func LockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	f.Close()
+	return &FileLock{path: path}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	return os.Remove(l.path)
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileLock is an exclusive lock of a file, it is released by Unlock or when the process exits
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile takes the lock of the file at path, which is created if not exist.
+// It return ErrLocked at once if the lock is held.
+func LockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	return l.f.Close()
+}
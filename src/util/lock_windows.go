@@ -0,0 +1,35 @@
+package util
+
+import (
+	"syscall"
+)
+
+const errorSharingViolation syscall.Errno = 32
+
+// FileLock is an exclusive lock of a file, it is released by Unlock or when the process exits
+type FileLock struct {
+	handle syscall.Handle
+}
+
+// LockFile takes the lock of the file at path, which is created if not exist.
+// It return ErrLocked at once if the lock is held.
+func LockFile(path string) (*FileLock, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	// a file opened without sharing can not be opened again until it is closed
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errorSharingViolation {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &FileLock{handle: handle}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	return syscall.CloseHandle(l.handle)
+}
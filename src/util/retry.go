@@ -0,0 +1,59 @@
+package util
+
+import (
+	"context"
+	"math"
+	"time"
+	"values"
+)
+
+// RetryPolicy retries a failed operation up to MaxAttempts times in total. The first retry waits
+// InitialDelay, each next one waits Factor times longer, but not longer than MaxDelay if it is set.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	Factor       float64
+	MaxDelay     time.Duration
+}
+
+// CommandRetryPolicy is the retry of external commands run outside of tasks, like robocopy of the installer.
+// The copy engines of tasks are retried by the retry of the task.
+var CommandRetryPolicy = RetryPolicy{
+	MaxAttempts:  values.CommandRetryCount,
+	InitialDelay: values.CommandRetryDelay,
+	Factor:       values.RetryBackoffFactor,
+	MaxDelay:     values.CommandRetryMaxDelay,
+}
+
+// Delay return the wait before the retry after the n-th failure, n starts from 1
+func (p RetryPolicy) Delay(n int) time.Duration {
+	factor := p.Factor
+	if factor < 1 {
+		factor = 1
+	}
+	delay := float64(p.InitialDelay) * math.Pow(factor, float64(n-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// Do calls f until it succeeds or MaxAttempts is reached, and return the last error.
+// It stops waiting for the next attempt when ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, f func() error) (err error) {
+	for n := 1; ; n++ {
+		if err = f(); err == nil || n >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		timer := time.NewTimer(p.Delay(n))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
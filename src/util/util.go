@@ -2,10 +2,12 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"mahonia"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +28,14 @@ func Exists(path string) bool {
 	return true
 }
 
+// IsWithin report whether path is root or under it, both should be absolute
+func IsWithin(root, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
 func ParseDuration(duration string) (t time.Duration, err error) {
 	numberBytes := []byte("1234567890")
@@ -73,28 +83,46 @@ func ParseDuration(duration string) (t time.Duration, err error) {
 }
 
 
-func RunCommandWithRetry(count int, name string, args ...string) (output string, err error) {
-	for i := 0; i < count; i++ {
-		output, err = RunCommand(name, args...)
-		if err == nil {
-			return output, err
-		}
-	}
+// Run os command, and retry it by the policy if it fails
+func RunCommandWithRetry(ctx context.Context, policy RetryPolicy, name string, args ...string) (output string, err error) {
+	err = policy.Do(ctx, func() error {
+		var e error
+		output, e = RunCommandContext(ctx, name, args...)
+		return e
+	})
+	return output, err
+}
+
+// Run robocopy, and retry it by the policy if it fails, see DealRobocopyResult
+func RunRobocopyWithRetry(ctx context.Context, policy RetryPolicy, args ...string) (output string, err error) {
+	err = policy.Do(ctx, func() error {
+		var e error
+		output, e = DealRobocopyResult(RunCommandContext(ctx, "robocopy", args...))
+		return e
+	})
 	return output, err
 }
 
 
 // Run os command and return output
 func RunCommand(name string, args ...string) (output string, err error) {
+	return RunCommandContext(context.Background(), name, args...)
+}
+
+// Run os command and return output, the command is killed when ctx is done
+func RunCommandContext(ctx context.Context, name string, args ...string) (output string, err error) {
 	if CmdOutputDecoder == nil {
 		err = getCmdEncode()
 		if err != nil {
-			return "", nil
+			return "", errors.New("get the code page by chcp failed: " + err.Error())
 		}
 	}
-	cmd := exec.Command(name, args...)
+	cmd := exec.CommandContext(ctx, name, args...)
 	b, err := cmd.Output()
 	output = CmdOutputDecoder.ConvertString(string(b))
+	if ctx.Err() != nil {
+		return output, ctx.Err()
+	}
 	if err != nil {
 		return output, err
 	}
@@ -128,7 +156,7 @@ func getCmdEncode() error {
 //7	    Files were copied, a file mismatch was present, and additional files were present.
 //8	    Several files did not copy.
 func DealRobocopyResult(o string, e error) (output string, err error) {
-	if e != nil && strings.EqualFold(e.Error(), "exit status 2") {
+	if exitErr, ok := e.(*exec.ExitError); ok && exitErr.ExitCode() < 8 {
 		return o, nil
 	}
 	return o, e
@@ -142,3 +170,37 @@ func IsProcessRunning(processName string) (bool, error) {
 		return strings.Contains(output, processName), nil
 	}
 }
+
+// ParseTime parses a local time like "2006-01-02 15:04:05", "2006-01-02 15:04" or "2006-01-02"
+func ParseTime(s string) (t time.Time, err error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", "2006-01-02_150405"} {
+		t, err = time.ParseInLocation(layout, strings.TrimSpace(s), time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return t, errors.New("invalid time " + s + ", the format should be like 2006-01-02 15:04:05")
+}
+
+// ParseSize parses a size consisting of a number and an optional unit (B/K/M/G, KB/MB/GB), like 512K or 8MB
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "B")
+	var unit int64 = 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	count, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || count < 0 {
+		return 0, errors.New("invalid size " + size)
+	}
+	return count * unit, nil
+}
@@ -1,6 +1,14 @@
 package util
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -20,3 +28,117 @@ func TestParseDuration(t *testing.T) {
 	}
 }
 
+func TestIsWithin(t *testing.T) {
+	root := filepath.FromSlash("/data/docs")
+	for path, want := range map[string]bool{
+		"/data/docs":           true,
+		"/data/docs/a/b.txt":   true,
+		"/data/docs/../docs/a": true,
+		"/data/docs2":          false,
+		"/data":                false,
+		"/data/docs/../../etc": false,
+		"/other/docs":          false,
+	} {
+		if IsWithin(root, filepath.FromSlash(path)) != want {
+			t.Errorf("IsWithin(%v, %v) should be %v", root, path, want)
+		}
+	}
+}
+
+func TestDealRobocopyResult(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the exit codes are simulated by sh")
+	}
+	// robocopy exits with a bit mask, 8 and above means some files failed
+	for code, success := range map[int]bool{0: true, 1: true, 2: true, 3: true, 7: true, 8: false, 16: false} {
+		_, err := DealRobocopyResult("", exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run())
+		if (err == nil) != success {
+			t.Errorf("exit code %d: %v", code, err)
+		}
+	}
+	if _, err := DealRobocopyResult("", errors.New("not found")); err == nil {
+		t.Error("other errors should fail")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	expected := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	for _, s := range []string{"2020-01-02 03:04:05", "2020-01-02_030405"} {
+		if parsed, err := ParseTime(s); err != nil || !parsed.Equal(expected) {
+			t.Errorf("parse %s: %v %v", s, parsed, err)
+		}
+	}
+	if parsed, err := ParseTime("2020-01-02"); err != nil || !parsed.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("parse date: %v %v", parsed, err)
+	}
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Error("invalid time should fail")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{"100": 100, "100B": 100, "512K": 512 << 10, "512kb": 512 << 10, "8M": 8 << 20,
+		"8MB": 8 << 20, "2G": 2 << 30}
+	for s, expected := range sizes {
+		if size, err := ParseSize(s); err != nil || size != expected {
+			t.Errorf("parse %s: %v %v", s, size, err)
+		}
+	}
+	for _, s := range []string{"", "M", "-1K", "1T"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("parse %s should fail", s)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 4, InitialDelay: time.Second, Factor: 2, MaxDelay: 5 * time.Second}
+	for n, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if delay := p.Delay(n + 1); delay != expected {
+			t.Errorf("delay after %d failures: %v, expected %v", n+1, delay, expected)
+		}
+	}
+
+	p = RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, Factor: 2}
+	attempts := 0
+	err := p.Do(context.Background(), func() error {
+		attempts++
+		return errors.New("failed")
+	})
+	if err == nil || attempts != 3 {
+		t.Errorf("Do should try 3 times and fail, tried %d: %v", attempts, err)
+	}
+	attempts = 0
+	if err = p.Do(context.Background(), func() error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("failed")
+		}
+		return nil
+	}); err != nil || attempts != 2 {
+		t.Errorf("Do should succeed at the 2nd attempt, tried %d: %v", attempts, err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "task.lock")
+	l, err := LockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LockFile(path); err != ErrLocked {
+		t.Errorf("lock held should fail with ErrLocked, got %v", err)
+	}
+	if err = l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = LockFile(path); err != nil {
+		t.Fatalf("lock released should be taken again: %v", err)
+	}
+	l.Unlock()
+}
@@ -3,8 +3,32 @@ package values
 import "time"
 
 const (
-	RobocopyRetryCount int = 5
+	// attempts of external commands like robocopy, and the wait before the first retry
+	CommandRetryCount int = 5
+	CommandRetryDelay = time.Second * 2
+	CommandRetryMaxDelay = time.Minute
+	// the default wait before the first retry of a failed task
+	DefaultRetryDelay = time.Minute
+	// each retry waits longer than the previous one by the factor
+	RetryBackoffFactor = 2.0
 	MdRetryCount int = 1
 	MonitConfigPeriod = time.Second * 5
 	RecentRecordCount int = 32
+	// the max bytes of the copy engine output kept for the last failed run, the end is kept
+	MaxErrorOutput = 16 * 1024
+	// file systems like FAT only keep modification time in 2 seconds
+	ModTimeTolerance = time.Second * 2
+	TempFileSuffix = ".backup_tmp"
+	// default max ratio of dst files a mirror task can delete in one run
+	DefaultMaxDeleteRatio = 0.5
+	// the directory under dst of repository format tasks
+	RepositoryDirName = "repository"
+	// max wait before rechecking the wall clock for a scheduled run, timers do not count while the system sleeps
+	ScheduleCheckInterval = time.Minute
+	// defaults of the debounce of watch trigger
+	DefaultWatchQuietPeriod = time.Second * 30
+	DefaultWatchMaxDelay = time.Minute * 10
+	// default max wait for runs in progress when the daemon shuts down, and the wait after interrupting them
+	DefaultShutdownGrace = time.Second * 30
+	ShutdownInterruptWait = time.Second * 10
 )
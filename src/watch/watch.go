@@ -0,0 +1,66 @@
+package watch
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// the system can not watch more files or directories, like fs.inotify.max_user_watches is reached
+	ErrLimit = errors.New("watch limit exhausted")
+	// changes were lost as they came faster than read, everything may have changed
+	ErrOverflow = errors.New("watch events overflowed")
+	// watching is not implemented on this system
+	ErrUnsupported = errors.New("watching is not supported on this system")
+)
+
+// Watcher reports changes of a file, or of the files in a directory tree
+type Watcher interface {
+	// Events delivers the paths of changed files and directories
+	Events() <-chan string
+	// Errors delivers the errors while watching, ErrLimit means some changes are no longer reported
+	Errors() <-chan error
+	Close() error
+}
+
+// New return a watcher of root, a file or a directory watched recursively
+func New(root string) (Watcher, error) {
+	return newWatcher(root)
+}
+
+// Debouncer decides when to act on a burst of changes: once no change came for Quiet,
+// but at most MaxDelay after the first change, so constant changes can not delay it forever.
+type Debouncer struct {
+	Quiet    time.Duration
+	MaxDelay time.Duration
+	first    time.Time
+	last     time.Time
+}
+
+// Add records a change at now
+func (d *Debouncer) Add(now time.Time) {
+	if d.first.IsZero() {
+		d.first = now
+	}
+	d.last = now
+}
+
+// Pending report whether there are changes not acted on
+func (d *Debouncer) Pending() bool {
+	return !d.first.IsZero()
+}
+
+// Due return the time to act on the pending changes
+func (d *Debouncer) Due() time.Time {
+	due := d.last.Add(d.Quiet)
+	if d.MaxDelay > 0 && due.After(d.first.Add(d.MaxDelay)) {
+		due = d.first.Add(d.MaxDelay)
+	}
+	return due
+}
+
+// Reset forgets the pending changes, when they are acted on
+func (d *Debouncer) Reset() {
+	d.first = time.Time{}
+	d.last = time.Time{}
+}
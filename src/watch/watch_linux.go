@@ -0,0 +1,178 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+// inotifyWatcher watches every directory of the tree with inotify, new directories are added when created
+type inotifyWatcher struct {
+	file   *os.File
+	fd     int
+	events chan string
+	errors chan error
+	// the file name to report if root is a file, empty if root is a directory
+	name string
+
+	mu    sync.Mutex
+	paths map[int32]string
+	done  chan struct{}
+}
+
+func newWatcher(root string) (Watcher, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		// a non blocking fd is read through the runtime poller, so Close interrupts Read
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		events: make(chan string, 128),
+		errors: make(chan error, 8),
+		paths:  make(map[int32]string),
+		done:   make(chan struct{}),
+	}
+	if fi.IsDir() {
+		err = w.addTree(root)
+	} else {
+		w.name = fi.Name()
+		err = w.add(filepath.Dir(root))
+	}
+	if err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *inotifyWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *inotifyWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	close(w.done)
+	return w.file.Close()
+}
+
+func (w *inotifyWatcher) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err == syscall.ENOSPC {
+		return ErrLimit
+	} else if err != nil {
+		return os.NewSyscallError("inotify_add_watch "+dir, err)
+	}
+	w.mu.Lock()
+	w.paths[int32(wd)] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+// addTree watches dir and all directories in it
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// removed or unreadable directories are not watched
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return w.add(path)
+	})
+}
+
+func (w *inotifyWatcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				w.sendError(err)
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			w.handle(event, trimNull(nameBytes))
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(event *syscall.InotifyEvent, name string) {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.sendError(ErrOverflow)
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.paths[event.Wd]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.paths, event.Wd)
+	}
+	w.mu.Unlock()
+	if !ok || event.Mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+	if w.name != "" && name != w.name {
+		return
+	}
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+	if w.name == "" && event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := w.addTree(path); err != nil {
+			w.sendError(err)
+		}
+	}
+	select {
+	case w.events <- path:
+	case <-w.done:
+	}
+}
+
+func (w *inotifyWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
+	}
+}
+
+func trimNull(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
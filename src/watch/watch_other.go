@@ -0,0 +1,7 @@
+//go:build !linux && !windows
+
+package watch
+
+func newWatcher(root string) (Watcher, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,83 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	d := &Debouncer{Quiet: 10 * time.Second, MaxDelay: time.Minute}
+	if d.Pending() {
+		t.Fatal("new debouncer should not be pending")
+	}
+	start := time.Now()
+	d.Add(start)
+	if !d.Pending() || !d.Due().Equal(start.Add(10*time.Second)) {
+		t.Errorf("due = %v, want 10s after the change", d.Due().Sub(start))
+	}
+	d.Add(start.Add(5 * time.Second))
+	if !d.Due().Equal(start.Add(15 * time.Second)) {
+		t.Errorf("due = %v, want 10s after the last change", d.Due().Sub(start))
+	}
+	d.Add(start.Add(55 * time.Second))
+	if !d.Due().Equal(start.Add(time.Minute)) {
+		t.Errorf("due = %v, want max delay after the first change", d.Due().Sub(start))
+	}
+	d.Reset()
+	if d.Pending() {
+		t.Error("debouncer should not be pending after reset")
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := New(dir)
+	if err == ErrUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	expect := func(path string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case got := <-w.Events():
+				if got == path {
+					return
+				}
+			case err := <-w.Errors():
+				t.Fatal(err)
+			case <-timeout:
+				t.Fatalf("no event of %s", path)
+			}
+		}
+	}
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	expect(sub)
+	// directories created later are watched as well
+	file := filepath.Join(sub, "a.txt")
+	if err := ioutil.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect(file)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range w.Events() {
+	}
+}
@@ -0,0 +1,119 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const notifyFilter = syscall.FILE_NOTIFY_CHANGE_FILE_NAME | syscall.FILE_NOTIFY_CHANGE_DIR_NAME |
+	syscall.FILE_NOTIFY_CHANGE_ATTRIBUTES | syscall.FILE_NOTIFY_CHANGE_SIZE | syscall.FILE_NOTIFY_CHANGE_LAST_WRITE
+
+// dirWatcher watches a directory tree with ReadDirectoryChangesW, which is recursive by itself
+type dirWatcher struct {
+	handle syscall.Handle
+	dir    string
+	events chan string
+	errors chan error
+	// the file name to report if root is a file, empty if root is a directory
+	name string
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newWatcher(root string) (Watcher, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	w := &dirWatcher{
+		dir:    root,
+		events: make(chan string, 128),
+		errors: make(chan error, 8),
+		done:   make(chan struct{}),
+	}
+	if !fi.IsDir() {
+		w.dir = filepath.Dir(root)
+		w.name = fi.Name()
+	}
+	p, err := syscall.UTF16PtrFromString(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	w.handle, err = syscall.CreateFile(p, syscall.FILE_LIST_DIRECTORY,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFile "+w.dir, err)
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *dirWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *dirWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *dirWatcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		// interrupt the pending ReadDirectoryChanges
+		syscall.CancelIoEx(w.handle, nil)
+		err = syscall.CloseHandle(w.handle)
+	})
+	return err
+}
+
+func (w *dirWatcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		var n uint32
+		err := syscall.ReadDirectoryChanges(w.handle, &buf[0], uint32(len(buf)), w.name == "", notifyFilter, &n, nil, 0)
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		if err != nil {
+			w.sendError(os.NewSyscallError("ReadDirectoryChanges", err))
+			return
+		}
+		if n == 0 {
+			// the buffer was too small for the changes
+			w.sendError(ErrOverflow)
+			continue
+		}
+		for offset := uint32(0); ; {
+			info := (*syscall.FileNotifyInformation)(unsafe.Pointer(&buf[offset]))
+			name := syscall.UTF16ToString((*[32768]uint16)(unsafe.Pointer(&info.FileName))[:info.FileNameLength/2])
+			if w.name == "" || strings.EqualFold(name, w.name) {
+				select {
+				case w.events <- filepath.Join(w.dir, name):
+				case <-w.done:
+					return
+				}
+			}
+			if info.NextEntryOffset == 0 {
+				break
+			}
+			offset += info.NextEntryOffset
+		}
+	}
+}
+
+func (w *dirWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.done:
+	}
+}